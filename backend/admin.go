@@ -0,0 +1,460 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// requireAdmin checks that the request carries the admin token as a bearer token.
+// It writes an error response and returns false if it does not.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if *adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func isSHA256(id string) bool {
+	_, err := hex.DecodeString(id)
+	return err == nil && len(id) == 64
+}
+
+// quarantineDir is where quarantined files are moved to, so they can no longer be downloaded.
+func quarantineDir() string {
+	return filepath.Join(*dataDir, ".quarantine")
+}
+
+// likeEscaper escapes the wildcards of a LIKE pattern. ! is used as the escape character, since a
+// backslash would need escaping again in MySQL string literals.
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// escapeLike makes s match literally in a LIKE pattern with ESCAPE '!'.
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// parsePagination reads the page and limit query parameters, page starts at 1.
+func parsePagination(r *http.Request) (page, limit int) {
+	page, _ = strconv.Atoi(r.URL.Query().Get("page"))
+	limit, _ = strconv.Atoi(r.URL.Query().Get("limit"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 {
+		limit = 50
+	}
+	if limit > 500 {
+		limit = 500
+	}
+	return page, limit
+}
+
+// parseTime parses a unix timestamp, an RFC 3339 time or a YYYY-MM-DD date.
+func parseTime(s string) (int64, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.Unix(), nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.Unix(), nil
+}
+
+// deleteUpload removes a file and every database entry for it.
+func deleteUpload(id string) error {
+	if err := purgeImageCache(id); err != nil {
+		return err
+	}
+	for _, path := range []string{blobPath(id), legacyBlobPath(id), filepath.Join(quarantineDir(), id)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if _, err := db.Exec("DELETE FROM quarantine WHERE id = ?", id); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM uploads WHERE data_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM pastes WHERE data_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM album_items WHERE data_id = ?", id); err != nil {
+		return err
+	}
+	_, err := db.Exec("DELETE FROM data WHERE id = ?", id)
+	return err
+}
+
+// isQuarantined reports whether a file has been quarantined.
+func isQuarantined(id string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM quarantine WHERE id = ?", id).Scan(&count)
+	return count > 0, err
+}
+
+// quarantineUpload moves a file out of the data folder and records why. The database entry is kept
+// so the file can be restored later, or deleted for good by the gc job.
+func quarantineUpload(id, reason string) error {
+	quarantined, err := isQuarantined(id)
+	if err != nil {
+		return err
+	}
+	if quarantined {
+		return nil
+	}
+
+	path, err := resolveBlob(id)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(quarantineDir(), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(path, filepath.Join(quarantineDir(), id)); err != nil {
+		return err
+	}
+	if err := purgeImageCache(id); err != nil {
+		logger.Println("Failed to remove cached images of", id, err)
+	}
+
+	_, err = db.Exec("INSERT INTO quarantine (id, reason, quarantined) VALUES (?, ?, ?)", id, reason, time.Now().Unix())
+	return err
+}
+
+// restoreUpload moves a quarantined file back into the data folder.
+func restoreUpload(id string) error {
+	quarantined, err := isQuarantined(id)
+	if err != nil {
+		return err
+	}
+	if !quarantined {
+		return errors.New("file is not quarantined")
+	}
+
+	path, err := prepareBlobPath(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(quarantineDir(), id), path); err != nil {
+		return err
+	}
+
+	_, err = db.Exec("DELETE FROM quarantine WHERE id = ?", id)
+	return err
+}
+
+func handleAdminUploads(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w, r, adminCors)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		params := r.URL.Query()
+		page, limit := parsePagination(r)
+
+		var where []string
+		var args []interface{}
+
+		if q := params.Get("q"); q != "" {
+			where = append(where, "(d.id LIKE ? ESCAPE '!' OR d.sha1 LIKE ? ESCAPE '!' OR d.md5 LIKE ? ESCAPE '!' OR d.crc32 LIKE ? ESCAPE '!')")
+			q = escapeLike(q)
+			args = append(args, q+"%", q+"%", q+"%", q+"%")
+		}
+		if t := params.Get("type"); t != "" {
+			where = append(where, "d.type LIKE ? ESCAPE '!'")
+			args = append(args, strings.ReplaceAll(escapeLike(t), "*", "%"))
+		}
+		for param, cond := range map[string]string{"from": "d.uploaded >= ?", "to": "d.uploaded <= ?"} {
+			if v := params.Get(param); v != "" {
+				t, err := parseTime(v)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				where = append(where, cond)
+				args = append(args, t)
+			}
+		}
+		for param, cond := range map[string]string{"minsize": "d.size >= ?", "maxsize": "d.size <= ?"} {
+			if v := params.Get(param); v != "" {
+				n, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					http.Error(w, "Invalid "+param, http.StatusBadRequest)
+					return
+				}
+				where = append(where, cond)
+				args = append(args, n)
+			}
+		}
+		switch params.Get("quarantined") {
+		case "true":
+			where = append(where, "q.id IS NOT NULL")
+		case "false":
+			where = append(where, "q.id IS NULL")
+		}
+
+		query := "FROM data d LEFT JOIN quarantine q ON q.id = d.id"
+		if len(where) > 0 {
+			query += " WHERE " + strings.Join(where, " AND ")
+		}
+
+		var total int64
+		if err := db.QueryRow("SELECT COUNT(*) "+query, args...).Scan(&total); err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			return
+		}
+
+		rows, err := db.Query("SELECT d.id, d.sha1, d.md5, d.crc32, d.type, d.size, d.uploaded, q.id IS NOT NULL "+query+" ORDER BY d.uploaded DESC LIMIT ? OFFSET ?",
+			append(args, limit, (page-1)*limit)...)
+		if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		items := []UploadInfo{}
+		for rows.Next() {
+			var u UploadInfo
+			var contentType sql.NullString
+			var size sql.NullInt64
+			if err := rows.Scan(&u.ID, &u.SHA1, &u.MD5, &u.CRC32, &contentType, &size, &u.Uploaded, &u.Quarantined); err != nil {
+				http.Error(w, "Failed to query database", http.StatusInternalServerError)
+				return
+			}
+			u.Type = contentType.String
+			u.Size = size.Int64
+			items = append(items, u)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			return
+		}
+
+		response := map[string]interface{}{
+			"items": items,
+			"total": total,
+			"page":  page,
+			"limit": limit,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		if !isSHA256(id) {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+		if err := deleteUpload(id); err != nil {
+			http.Error(w, "Failed to delete file", http.StatusInternalServerError)
+			return
+		}
+		logLevelln(0, "Deleted file "+id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// decodeAdminUploadRequest decodes the body of the quarantine, restore and block endpoints.
+func decodeAdminUploadRequest(w http.ResponseWriter, r *http.Request) (id, reason string, ok bool) {
+	enableCors(&w, r, adminCors)
+	if r.Method == "OPTIONS" {
+		return "", "", false
+	}
+	if !requireAdmin(w, r) {
+		return "", "", false
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return "", "", false
+	}
+
+	var request struct {
+		ID     string `json:"id"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return "", "", false
+	}
+	if !isSHA256(request.ID) {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return "", "", false
+	}
+
+	return request.ID, request.Reason, true
+}
+
+func handleAdminQuarantine(w http.ResponseWriter, r *http.Request) {
+	id, reason, ok := decodeAdminUploadRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if err := quarantineUpload(id, reason); err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, "Failed to quarantine file", http.StatusInternalServerError)
+		return
+	}
+
+	logLevelln(0, "Quarantined file "+id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleAdminRestore(w http.ResponseWriter, r *http.Request) {
+	id, _, ok := decodeAdminUploadRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if err := restoreUpload(id); err != nil {
+		http.Error(w, "Failed to restore file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	logLevelln(0, "Restored file "+id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminBlock adds a file to the blocklist and quarantines it.
+func handleAdminBlock(w http.ResponseWriter, r *http.Request) {
+	id, reason, ok := decodeAdminUploadRequest(w, r)
+	if !ok {
+		return
+	}
+
+	err := addBlockEntry(BlockEntry{Hash: id, Algo: "sha256", Reason: reason, Source: "admin"})
+	if err != nil {
+		http.Error(w, "Failed to add blocklist entry", http.StatusInternalServerError)
+		return
+	}
+
+	if err := quarantineUpload(id, reason); err != nil && !os.IsNotExist(err) {
+		http.Error(w, "Failed to quarantine file", http.StatusInternalServerError)
+		return
+	}
+
+	logLevelln(0, "Blocked file "+id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleAdminURLs(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w, r, adminCors)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		params := r.URL.Query()
+		page, limit := parsePagination(r)
+
+		var where []string
+		var args []interface{}
+
+		if q := params.Get("q"); q != "" {
+			where = append(where, "(id = ? OR url LIKE ? ESCAPE '!')")
+			args = append(args, q, "%"+escapeLike(q)+"%")
+		}
+		for param, cond := range map[string]string{"from": "uploaded >= ?", "to": "uploaded <= ?"} {
+			if v := params.Get(param); v != "" {
+				t, err := parseTime(v)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				where = append(where, cond)
+				args = append(args, t)
+			}
+		}
+
+		query := "FROM urls"
+		if len(where) > 0 {
+			query += " WHERE " + strings.Join(where, " AND ")
+		}
+
+		var total int64
+		if err := db.QueryRow("SELECT COUNT(*) "+query, args...).Scan(&total); err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			return
+		}
+
+		rows, err := db.Query("SELECT id, url, hits, uploaded, expires, max_hits, disabled "+query+" ORDER BY uploaded DESC LIMIT ? OFFSET ?",
+			append(args, limit, (page-1)*limit)...)
+		if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		items := []ShortLink{}
+		for rows.Next() {
+			var l ShortLink
+			var hits, uploaded sql.NullInt64
+			var disabled int
+			if err := rows.Scan(&l.ID, &l.URL, &hits, &uploaded, &l.Expires, &l.MaxHits, &disabled); err != nil {
+				http.Error(w, "Failed to query database", http.StatusInternalServerError)
+				return
+			}
+			l.Hits = hits.Int64
+			l.Uploaded = uploaded.Int64
+			l.Disabled = disabled == 1
+			items = append(items, l)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			return
+		}
+
+		response := map[string]interface{}{
+			"items": items,
+			"total": total,
+			"page":  page,
+			"limit": limit,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		if _, _, err := getShortLink(id); err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		if err := deleteShortLink(id); err != nil {
+			http.Error(w, "Failed to delete URL", http.StatusInternalServerError)
+			return
+		}
+		logLevelln(0, "Deleted short URL "+id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
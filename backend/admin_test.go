@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAdminURLSearchLiteral(t *testing.T) {
+	setupTestDB(t)
+	setFlag(t, adminToken, "secret")
+	for id, link := range map[string]string{
+		"a": "https://example.com/100%_done",
+		"b": "https://example.com/100x_done",
+		"c": "https://example.com/1000done",
+		"d": "https://example.com/wow!",
+	} {
+		if _, err := db.Exec("INSERT INTO urls (id, url, hits, uploaded) VALUES (?, ?, 0, 0)", id, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		q    string
+		want string
+	}{
+		{"100%_", "a"},
+		// Unescaped, _ would match the 0 of 1000done
+		{"0_d", ""},
+		{"wow!", "d"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/admin/urls?q="+url.QueryEscape(tt.q), nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		handleAdminURLs(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("search %q = %d %s", tt.q, w.Code, w.Body.String())
+		}
+		var response struct {
+			Items []ShortLink `json:"items"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, item := range response.Items {
+			ids = append(ids, item.ID)
+		}
+		if got := strings.Join(ids, ","); got != tt.want {
+			t.Errorf("search %q = %q, want %q", tt.q, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// createAlbum stores an album with its files in order.
+func createAlbum(title string, files []AlbumFile) (Album, error) {
+	album := Album{ID: randomBase62(8), Title: title, Created: time.Now().Unix(), Files: files}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return album, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT INTO albums (id, title, created) VALUES (?, ?, ?)", album.ID, album.Title, album.Created); err != nil {
+		return album, err
+	}
+	for i, file := range files {
+		if _, err := tx.Exec("INSERT INTO album_items (album_id, position, data_id, name) VALUES (?, ?, ?, ?)", album.ID, i, file.SHA256, file.Name); err != nil {
+			return album, err
+		}
+	}
+	return album, tx.Commit()
+}
+
+// loadAlbum returns an album with its files in order. Files that have been deleted are left out.
+func loadAlbum(id string) (Album, error) {
+	var album Album
+	var title sql.NullString
+	err := db.QueryRow("SELECT id, title, created FROM albums WHERE id = ?", id).Scan(&album.ID, &title, &album.Created)
+	if err != nil {
+		return album, err
+	}
+	album.Title = title.String
+
+	rows, err := db.Query(`SELECT i.data_id, i.name, d.type, d.size FROM album_items i
+		JOIN data d ON d.id = i.data_id WHERE i.album_id = ? ORDER BY i.position`, id)
+	if err != nil {
+		return album, err
+	}
+	defer rows.Close()
+
+	album.Files = []AlbumFile{}
+	for rows.Next() {
+		var file AlbumFile
+		var name, contentType sql.NullString
+		var size sql.NullInt64
+		if err := rows.Scan(&file.SHA256, &name, &contentType, &size); err != nil {
+			return album, err
+		}
+		file.Name = name.String
+		file.Type = contentType.String
+		file.Size = size.Int64
+		album.Files = append(album.Files, file)
+	}
+	return album, rows.Err()
+}
+
+// storeAlbumUpload stores every file uploaded to /store as files[] and creates an album of them.
+func storeAlbumUpload(w http.ResponseWriter, r *http.Request, headers []*multipart.FileHeader) {
+	if len(headers) > *albumMaxFiles {
+		http.Error(w, fmt.Sprintf("Too many files, an album can have at most %d", *albumMaxFiles), http.StatusBadRequest)
+		return
+	}
+
+	var responses []StoreResponse
+	var files []AlbumFile
+	for _, header := range headers {
+		response, _, err := storeUpload(r, header)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		responses = append(responses, response)
+		files = append(files, AlbumFile{SHA256: response.SHA256, Name: cleanFilename(header.Filename)})
+	}
+
+	album, err := createAlbum(r.FormValue("title"), files)
+	if err == nil {
+		// Load the album again to get the type and size of every file
+		album, err = loadAlbum(album.ID)
+	}
+	if err != nil {
+		http.Error(w, "Failed to create album", http.StatusInternalServerError)
+		return
+	}
+	album.Zip = baseURL(r) + "/zip/" + album.ID
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		Album Album           `json:"album"`
+		Files []StoreResponse `json:"files"`
+	}{album, responses})
+}
+
+// handleAlbum creates albums of stored files and returns them as JSON.
+func handleAlbum(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w, r, apiCors)
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		id := strings.TrimPrefix(r.URL.Path, "/album/")
+		album, err := loadAlbum(id)
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			return
+		}
+		album.Zip = baseURL(r) + "/zip/" + album.ID
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(album)
+
+	case http.MethodPost:
+		if *disableUpload {
+			http.Error(w, "Uploading is disabled", http.StatusForbidden)
+			return
+		}
+
+		var request struct {
+			Title string   `json:"title"`
+			Files []string `json:"files"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024*1024)).Decode(&request); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if len(request.Files) == 0 {
+			http.Error(w, "No files provided", http.StatusBadRequest)
+			return
+		}
+		if len(request.Files) > *albumMaxFiles {
+			http.Error(w, fmt.Sprintf("Too many files, an album can have at most %d", *albumMaxFiles), http.StatusBadRequest)
+			return
+		}
+
+		var files []AlbumFile
+		for _, id := range request.Files {
+			var file AlbumFile
+			var contentType sql.NullString
+			var size sql.NullInt64
+			err := db.QueryRow("SELECT id, type, size FROM data WHERE id = ?", id).Scan(&file.SHA256, &contentType, &size)
+			if err == sql.ErrNoRows {
+				http.Error(w, "Unknown file "+id, http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				http.Error(w, "Failed to query database", http.StatusInternalServerError)
+				return
+			}
+			file.Type = contentType.String
+			file.Size = size.Int64
+			if upload, err := latestUpload(id); err == nil {
+				file.Name = upload.Name
+			}
+			files = append(files, file)
+		}
+
+		album, err := createAlbum(request.Title, files)
+		if err != nil {
+			http.Error(w, "Failed to create album", http.StatusInternalServerError)
+			return
+		}
+		album.Zip = baseURL(r) + "/zip/" + album.ID
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(album)
+
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAlbumZip streams an album as a ZIP file.
+func handleAlbumZip(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&downloadCount, 1)
+	defer atomic.AddInt64(&downloadCount, -1)
+
+	enableCors(&w, r, contentCors)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if !requireSignature(w, r) {
+		return
+	}
+
+	id := r.URL.Path[len("/zip/"):]
+	album, err := loadAlbum(id)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		return
+	}
+
+	entries := make([]archiveEntry, len(album.Files))
+	for i, file := range album.Files {
+		entries[i] = archiveEntry{ID: file.SHA256, Name: file.Name, Type: file.Type}
+	}
+
+	filename := archiveFilename(album.Title, "album-"+album.ID, ".zip")
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	if err := writeZip(w, entries); err != nil {
+		logger.Println("Failed to send album", id, err)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// archiveEntry is a stored file that is added to an archive under a name.
+type archiveEntry struct {
+	ID   string
+	Name string
+	Type string
+}
+
+// archiveNames gives every entry a unique, safe name. Entries without a name are named after their
+// hash, with an extension matching their type.
+func archiveNames(entries []archiveEntry) {
+	used := map[string]bool{}
+	for i := range entries {
+		name := cleanFilename(entries[i].Name)
+		if name == "" {
+			name = entries[i].ID
+			if exts, _ := mime.ExtensionsByType(entries[i].Type); len(exts) > 0 {
+				name += exts[0]
+			}
+		}
+
+		ext := filepath.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		for n := 2; used[strings.ToLower(name)]; n++ {
+			name = fmt.Sprintf("%s (%d)%s", base, n, ext)
+		}
+		used[strings.ToLower(name)] = true
+		entries[i].Name = name
+	}
+}
+
+// isCompressible reports whether it is worth compressing a file of the given type.
+func isCompressible(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+xml"),
+		strings.HasSuffix(mediaType, "+json"),
+		mediaType == "application/json",
+		mediaType == "application/xml",
+		mediaType == "application/javascript":
+		return true
+	}
+	return false
+}
+
+// writeZip streams a ZIP file with the entries straight from storage. Entries whose file is missing
+// or blocked are skipped, since the response has already started.
+func writeZip(w io.Writer, entries []archiveEntry) error {
+	archiveNames(entries)
+
+	zw := zip.NewWriter(w)
+	for _, entry := range entries {
+		path, ok := archiveSource(entry)
+		if !ok {
+			continue
+		}
+
+		method := zip.Store
+		if isCompressible(entry.Type) {
+			method = zip.Deflate
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			logger.Println("Failed to open file for archive", entry.ID, err)
+			continue
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			continue
+		}
+
+		header := &zip.FileHeader{Name: entry.Name, Method: method, Modified: info.ModTime()}
+		header.UncompressedSize64 = uint64(info.Size())
+		part, err := zw.CreateHeader(header)
+		if err == nil {
+			_, err = io.Copy(part, file)
+		}
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// writeTarGz streams a gzip compressed tar file with the entries straight from storage, like writeZip.
+func writeTarGz(w io.Writer, entries []archiveEntry) error {
+	archiveNames(entries)
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, entry := range entries {
+		path, ok := archiveSource(entry)
+		if !ok {
+			continue
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			logger.Println("Failed to open file for archive", entry.ID, err)
+			continue
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			continue
+		}
+
+		header := &tar.Header{Name: entry.Name, Mode: 0644, Size: info.Size(), ModTime: info.ModTime(), Typeflag: tar.TypeReg}
+		err = tw.WriteHeader(header)
+		if err == nil {
+			_, err = io.Copy(tw, file)
+		}
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// archiveSource returns the path of an entry, or false if it is missing or blocked.
+func archiveSource(entry archiveEntry) (string, bool) {
+	blocked, _, err := blockedByID(entry.ID)
+	if err != nil || blocked {
+		return "", false
+	}
+	path, err := resolveBlob(entry.ID)
+	if err != nil {
+		logger.Println("Skipping missing file in archive", entry.ID)
+		return "", false
+	}
+	return path, true
+}
+
+// archiveFilename returns a safe filename for an archive, falling back to fallback.
+func archiveFilename(title, fallback, ext string) string {
+	name := cleanFilename(title)
+	if name == "" {
+		name = fallback
+	}
+	return name + ext
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hexahigh/yapc/backend/lib/hash"
+)
+
+// algoFromLength guesses the hash algorithm from the length of a hex encoded hash.
+func algoFromLength(h string) string {
+	switch len(h) {
+	case 32:
+		return "md5"
+	case 40:
+		return "sha1"
+	case 64:
+		return "sha256"
+	default:
+		return ""
+	}
+}
+
+func isPerceptualAlgo(algo string) bool {
+	return algo == "ahash" || algo == "dhash"
+}
+
+// normalizeBlockEntry validates a blocklist entry and fills in the algorithm if it was left out.
+func normalizeBlockEntry(e *BlockEntry) error {
+	e.Hash = strings.ToLower(strings.TrimSpace(e.Hash))
+	e.Algo = strings.ToLower(strings.TrimSpace(e.Algo))
+
+	if _, err := hex.DecodeString(e.Hash); err != nil || e.Hash == "" {
+		return errors.New("hash must be a hex string")
+	}
+
+	if e.Algo == "" {
+		e.Algo = algoFromLength(e.Hash)
+		if e.Algo == "" {
+			return errors.New("could not determine the hash algorithm, please specify it")
+		}
+	}
+
+	switch {
+	case isPerceptualAlgo(e.Algo):
+		if e.Distance != nil && *e.Distance < 0 {
+			return errors.New("distance must not be negative")
+		}
+	case algoFromLength(e.Hash) == e.Algo:
+		e.Distance = nil
+	default:
+		return fmt.Errorf("hash is not a valid %s hash", e.Algo)
+	}
+
+	return nil
+}
+
+// parseBlockLine parses a single line of a hash list. The format is
+//
+//	[algo:]hash[:distance] [reason]
+//
+// The algorithm may be left out for sha256, sha1 and md5 hashes, and the distance is only
+// used for ahash and dhash entries. Empty lines and lines starting with # are ignored,
+// in which case ok is false.
+func parseBlockLine(line string) (e BlockEntry, ok bool, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return e, false, nil
+	}
+
+	spec, reason, _ := strings.Cut(line, " ")
+	e.Reason = strings.TrimSpace(reason)
+
+	parts := strings.Split(spec, ":")
+	switch len(parts) {
+	case 1:
+		e.Hash = parts[0]
+	case 2:
+		e.Algo, e.Hash = parts[0], parts[1]
+	case 3:
+		e.Algo, e.Hash = parts[0], parts[1]
+		distance, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return e, false, fmt.Errorf("invalid distance %q", parts[2])
+		}
+		e.Distance = &distance
+	default:
+		return e, false, fmt.Errorf("invalid entry %q", spec)
+	}
+
+	if err := normalizeBlockEntry(&e); err != nil {
+		return e, false, err
+	}
+
+	return e, true, nil
+}
+
+// addBlockEntry inserts an entry into the blocklist, replacing any existing entry for the same hash.
+func addBlockEntry(e BlockEntry) error {
+	if err := normalizeBlockEntry(&e); err != nil {
+		return err
+	}
+	if e.Added == 0 {
+		e.Added = time.Now().Unix()
+	}
+
+	// -1 stands for no distance, so the default applies
+	distance := -1
+	if e.Distance != nil {
+		distance = *e.Distance
+	}
+
+	_, err := db.Exec("DELETE FROM blocklist WHERE hash = ?", e.Hash)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("INSERT INTO blocklist (hash, algo, distance, reason, source, added) VALUES (?, ?, ?, ?, ?, ?)",
+		e.Hash, e.Algo, distance, e.Reason, e.Source, e.Added)
+	return err
+}
+
+// importBlocklist reads a hash list from r and adds every entry to the blocklist.
+// It returns the number of entries imported.
+func importBlocklist(r io.Reader, source string) (int, error) {
+	scanner := bufio.NewScanner(r)
+	count := 0
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		e, ok, err := parseBlockLine(scanner.Text())
+		if err != nil {
+			return count, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		if !ok {
+			continue
+		}
+		e.Source = source
+		if err := addBlockEntry(e); err != nil {
+			return count, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		count++
+	}
+	return count, scanner.Err()
+}
+
+func importBlocklistFile(path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Failed to open blocklist: %v", err)
+	}
+	defer file.Close()
+
+	count, err := importBlocklist(file, path)
+	if err != nil {
+		log.Fatalf("Failed to import blocklist: %v", err)
+	}
+	logLevelln(0, fmt.Sprintf("Imported %d blocklist entries from %s", count, path))
+}
+
+// checkBlocked checks a set of hashes, keyed by algorithm like in handleStore, against the blocklist.
+// Exact hashes must match an entry, perceptual hashes must be within the distance of an entry.
+func checkBlocked(hashes map[string]string) (bool, string, error) {
+	var reason sql.NullString
+	err := db.QueryRow("SELECT reason FROM blocklist WHERE hash IN (?, ?, ?)",
+		strings.ToLower(hashes["sha256"]), strings.ToLower(hashes["sha1"]), strings.ToLower(hashes["md5"])).Scan(&reason)
+	if err == nil {
+		return true, reason.String, nil
+	}
+	if err != sql.ErrNoRows {
+		return false, "", err
+	}
+
+	if hashes["ahash"] == "" && hashes["dhash"] == "" {
+		return false, "", nil
+	}
+
+	rows, err := db.Query("SELECT hash, algo, distance, reason FROM blocklist WHERE algo = 'ahash' OR algo = 'dhash'")
+	if err != nil {
+		return false, "", err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entryHash, algo string
+		var distance int
+		if err := rows.Scan(&entryHash, &algo, &distance, &reason); err != nil {
+			return false, "", err
+		}
+		if hashes[algo] == "" {
+			continue
+		}
+		if distance < 0 {
+			distance = *blocklistDistance
+		}
+
+		a, err1 := hex.DecodeString(entryHash)
+		b, err2 := hex.DecodeString(hashes[algo])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		dist, err := hash.Distance(a, b)
+		if err != nil {
+			// Hashes of a different length can not be compared
+			continue
+		}
+		if dist <= distance {
+			return true, reason.String, nil
+		}
+	}
+
+	return false, "", rows.Err()
+}
+
+// migrateBlocklistDistance marks perceptual entries stored with a distance of 0 as having no
+// distance. 0 used to mean the default, it now only matches identical hashes.
+func migrateBlocklistDistance() {
+	done, err := getMeta("blocklist_distance_unset")
+	if err != nil {
+		log.Fatalf("Failed to read meta: %v", err)
+	}
+	if done != "" {
+		return
+	}
+	_, err = db.Exec("UPDATE blocklist SET distance = -1 WHERE distance = 0 AND (algo = 'ahash' OR algo = 'dhash')")
+	if err != nil {
+		log.Fatalf("Failed to migrate blocklist table: %v", err)
+	}
+	if err := setMeta("blocklist_distance_unset", "1"); err != nil {
+		log.Fatalf("Failed to write meta: %v", err)
+	}
+}
+
+// blockedByID checks if the file with the given id is blocked, using all of the hashes stored for it.
+func blockedByID(id string) (bool, string, error) {
+	hashes := map[string]string{"sha256": id}
+
+	var sha1, md5 string
+	var ahash, dhash sql.NullString
+	err := db.QueryRow("SELECT sha1, md5, ahash, dhash FROM data WHERE id = ?", id).Scan(&sha1, &md5, &ahash, &dhash)
+	if err != nil && err != sql.ErrNoRows {
+		return false, "", err
+	}
+	hashes["sha1"] = sha1
+	hashes["md5"] = md5
+	hashes["ahash"] = ahash.String
+	hashes["dhash"] = dhash.String
+
+	return checkBlocked(hashes)
+}
+
+func handleAdminBlocklist(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w, r, adminCors)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := db.Query("SELECT hash, algo, distance, reason, source, added FROM blocklist ORDER BY added DESC")
+		if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		entries := []BlockEntry{}
+		for rows.Next() {
+			var e BlockEntry
+			var distance int
+			var reason, source sql.NullString
+			if err := rows.Scan(&e.Hash, &e.Algo, &distance, &reason, &source, &e.Added); err != nil {
+				http.Error(w, "Failed to query database", http.StatusInternalServerError)
+				return
+			}
+			if isPerceptualAlgo(e.Algo) && distance >= 0 {
+				e.Distance = &distance
+			}
+			e.Reason = reason.String
+			e.Source = source.String
+			entries = append(entries, e)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	case http.MethodPost:
+		var e BlockEntry
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if e.Source == "" {
+			e.Source = "admin"
+		}
+		e.Added = 0
+		if err := normalizeBlockEntry(&e); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := addBlockEntry(e); err != nil {
+			http.Error(w, "Failed to add blocklist entry", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(e)
+	case http.MethodDelete:
+		h := strings.ToLower(r.URL.Query().Get("hash"))
+		if h == "" {
+			http.Error(w, "No hash provided", http.StatusBadRequest)
+			return
+		}
+		res, err := db.Exec("DELETE FROM blocklist WHERE hash = ?", h)
+		if err != nil {
+			http.Error(w, "Failed to delete blocklist entry", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleAdminBlocklistImport(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w, r, adminCors)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	source := r.URL.Query().Get("source")
+	if source == "" {
+		source = "import"
+	}
+
+	count, err := importBlocklist(r.Body, source)
+
+	response := map[string]interface{}{
+		"success":  err == nil,
+		"imported": count,
+		"error":    "",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		response["error"] = err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestBlocklistDistance(t *testing.T) {
+	setupTestDB(t)
+	setFlag(t, blocklistDistance, 10)
+
+	exact, ok, err := parseBlockLine("ahash:ff00ff00ff00ff00:0 Only this image")
+	if err != nil || !ok {
+		t.Fatalf("parseBlockLine = %v, %v", ok, err)
+	}
+	if exact.Distance == nil || *exact.Distance != 0 {
+		t.Fatalf("distance = %v, want 0", exact.Distance)
+	}
+	if err := addBlockEntry(exact); err != nil {
+		t.Fatal(err)
+	}
+	def, _, err := parseBlockLine("dhash:00ff00ff00ff00ff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if def.Distance != nil {
+		t.Fatalf("distance = %d, want none", *def.Distance)
+	}
+	if err := addBlockEntry(def); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		algo, hash string
+		want       bool
+	}{
+		{"ahash", "ff00ff00ff00ff00", true},
+		// A distance of 0 only matches the same hash
+		{"ahash", "ff00ff00ff00ff01", false},
+		// Entries without a distance use -blocklist:distance
+		{"dhash", "00ff00ff00ff00ff", true},
+		{"dhash", "00ff00ff00000000", false},
+		{"dhash", "00ff00ff00ff000f", true},
+	}
+	for _, tt := range tests {
+		blocked, _, err := checkBlocked(map[string]string{"sha256": "00", tt.algo: tt.hash})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blocked != tt.want {
+			t.Errorf("checkBlocked(%s:%s) = %v, want %v", tt.algo, tt.hash, blocked, tt.want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"sync/atomic"
+)
+
+// BundleRequest is the body of a request to /bundle.
+type BundleRequest struct {
+	// Format is zip or tar.gz, defaults to zip
+	Format string `json:"format"`
+	// Name is the filename of the bundle without extension
+	Name  string       `json:"name"`
+	Files []BundleFile `json:"files"`
+}
+
+type BundleFile struct {
+	// ID is the sha256, sha1, md5 or crc32 hash of the file
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// handleBundle streams a ZIP or tar.gz file with the requested files. Every file is checked before
+// anything is sent, so a bad id fails the whole request instead of giving an incomplete bundle.
+func handleBundle(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&downloadCount, 1)
+	defer atomic.AddInt64(&downloadCount, -1)
+
+	enableCors(&w, r, apiCors)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method, use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Signatures do not cover the body of a POST, so private instances only allow bundles to admins
+	if *signRequire && !requireAdmin(w, r) {
+		return
+	}
+
+	var req BundleRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4*1024*1024)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var ext, contentType string
+	switch req.Format {
+	case "", "zip":
+		ext, contentType = ".zip", "application/zip"
+	case "tar.gz", "tgz":
+		ext, contentType = ".tar.gz", "application/gzip"
+	default:
+		http.Error(w, "Invalid format, use zip or tar.gz", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Files) == 0 {
+		http.Error(w, "No files provided", http.StatusBadRequest)
+		return
+	}
+	if len(req.Files) > *bundleMaxFiles {
+		http.Error(w, fmt.Sprintf("Too many files, a bundle can have at most %d", *bundleMaxFiles), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	entries := make([]archiveEntry, 0, len(req.Files))
+	var total int64
+	for _, file := range req.Files {
+		id, fileType, err := resolveHash(file.ID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Unknown file "+file.ID, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			return
+		}
+
+		blocked, _, err := blockedByID(id)
+		if err != nil {
+			http.Error(w, "Failed to check blocklist", http.StatusInternalServerError)
+			return
+		}
+		if blocked {
+			http.Error(w, "File "+file.ID+" has been blocked", http.StatusUnavailableForLegalReasons)
+			return
+		}
+
+		path, err := resolveBlob(id)
+		if err != nil {
+			http.Error(w, "File "+file.ID+" is missing", http.StatusNotFound)
+			return
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			http.Error(w, "Failed to get file info", http.StatusInternalServerError)
+			return
+		}
+		total += info.Size()
+		if total > *bundleMaxSize {
+			http.Error(w, fmt.Sprintf("Bundle too large, it can be at most %d bytes", *bundleMaxSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		name := file.Name
+		if name == "" {
+			if upload, err := latestUpload(id); err == nil {
+				name = upload.Name
+			}
+		}
+		entries = append(entries, archiveEntry{ID: id, Name: name, Type: fileType})
+	}
+
+	filename := archiveFilename(req.Name, "bundle", ext)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	var err error
+	if ext == ".zip" {
+		err = writeZip(w, entries)
+	} else {
+		err = writeTarGz(w, entries)
+	}
+	if err != nil {
+		logger.Println("Failed to send bundle", err)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// clickEvent is a redirect of a short link.
+type clickEvent struct {
+	URLID    string
+	Clicked  int64
+	Referrer string
+	Agent    string
+	IPHash   string
+}
+
+// clickEvents is the queue of clicks waiting to be written by recordClicks. Redirects never wait
+// for the database, if the queue is full the click is only counted in the hits of the link.
+var clickEvents = make(chan clickEvent, 10000)
+
+// queueClick records a click of a short link in the background.
+func queueClick(r *http.Request, id string) {
+	event := clickEvent{
+		URLID:    id,
+		Clicked:  time.Now().Unix(),
+		Referrer: referrerHost(r.Referer()),
+		Agent:    agentFamily(r.UserAgent()),
+		IPHash:   hashIP(r),
+	}
+	select {
+	case clickEvents <- event:
+	default:
+		logLevelln(1, "Click queue is full, dropping click of "+id)
+	}
+}
+
+// referrerHost returns the lowercase host of a referrer, or an empty string if there is none.
+func referrerHost(referrer string) string {
+	u, err := url.Parse(referrer)
+	if err != nil {
+		return ""
+	}
+	host := strings.ToLower(u.Hostname())
+	if len(host) > 255 {
+		host = host[:255]
+	}
+	return host
+}
+
+// agentFamily sorts a user agent into a browser family. The order matters, since most browsers
+// claim to be several others as well.
+func agentFamily(agent string) string {
+	a := strings.ToLower(agent)
+	switch {
+	case a == "":
+		return "Unknown"
+	case strings.Contains(a, "bot"), strings.Contains(a, "crawl"), strings.Contains(a, "spider"),
+		strings.Contains(a, "preview"), strings.Contains(a, "facebookexternalhit"):
+		return "Bot"
+	case strings.HasPrefix(a, "curl/"), strings.HasPrefix(a, "wget/"), strings.HasPrefix(a, "python"),
+		strings.HasPrefix(a, "go-http-client"):
+		return "Tool"
+	case strings.Contains(a, "edg/"):
+		return "Edge"
+	case strings.Contains(a, "opr/"), strings.Contains(a, "opera"):
+		return "Opera"
+	case strings.Contains(a, "firefox/"):
+		return "Firefox"
+	case strings.Contains(a, "chrome/"), strings.Contains(a, "crios/"):
+		return "Chrome"
+	case strings.Contains(a, "safari/"):
+		return "Safari"
+	}
+	return "Other"
+}
+
+// recordClicks writes queued clicks to the database in batches, at most every second.
+func recordClicks() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var batch []clickEvent
+	for {
+		select {
+		case event := <-clickEvents:
+			batch = append(batch, event)
+			if len(batch) < 500 {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		if err := insertClicks(batch); err != nil {
+			logger.Println("Failed to record clicks", err)
+		}
+		batch = batch[:0]
+	}
+}
+
+func insertClicks(batch []clickEvent) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("INSERT INTO clicks (url_id, clicked, referrer, agent, ip_hash) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, event := range batch {
+		if _, err := stmt.Exec(event.URLID, event.Clicked, event.Referrer, event.Agent, event.IPHash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// pruneClicks deletes clicks older than -clicks:retention every hour. The hits of a link are kept.
+func pruneClicks() {
+	if *clickRetention <= 0 {
+		return
+	}
+	for {
+		res, err := db.Exec("DELETE FROM clicks WHERE clicked < ?", time.Now().Add(-*clickRetention).Unix())
+		if err != nil {
+			logger.Println("Failed to prune clicks", err)
+		} else if n, _ := res.RowsAffected(); n > 0 {
+			logLevelln(1, fmt.Sprintf("Pruned %d old clicks", n))
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// ClickStats is the response of /shorten/{id}/stats.
+type ClickStats struct {
+	ID   string `json:"id"`
+	Hits int64  `json:"hits"`
+	// Clicks and Unique only count the clicks in the range that have not been pruned yet
+	Clicks    int64        `json:"clicks"`
+	Unique    int64        `json:"unique"`
+	Bucket    string       `json:"bucket"`
+	Buckets   []ClickCount `json:"buckets"`
+	Referrers []ClickCount `json:"referrers"`
+	Agents    []ClickCount `json:"agents"`
+}
+
+// ClickCount is the number of clicks in a time bucket, from a referrer or from a user agent family.
+type ClickCount struct {
+	Time  int64  `json:"time,omitempty"`
+	Name  string `json:"name,omitempty"`
+	Count int64  `json:"count"`
+}
+
+// clickStats returns the clicks of a short link between from and to, grouped in buckets of size seconds.
+func clickStats(link ShortLink, from, to, size int64) (ClickStats, error) {
+	stats := ClickStats{ID: link.ID, Hits: link.Hits, Buckets: []ClickCount{}, Referrers: []ClickCount{}, Agents: []ClickCount{}}
+	where := "FROM clicks WHERE url_id = ? AND clicked >= ? AND clicked <= ?"
+	args := []interface{}{link.ID, from, to}
+
+	err := db.QueryRow("SELECT COUNT(*), COUNT(DISTINCT ip_hash) "+where, args...).Scan(&stats.Clicks, &stats.Unique)
+	if err != nil {
+		return stats, err
+	}
+
+	// Integer division differs between sqlite and mysql, the modulo does not
+	bucket := fmt.Sprintf("clicked - (clicked %% %d)", size)
+	rows, err := db.Query("SELECT "+bucket+" AS b, COUNT(*) "+where+" GROUP BY b ORDER BY b", args...)
+	if err != nil {
+		return stats, err
+	}
+	if stats.Buckets, err = scanClickCounts(rows, true, stats.Buckets); err != nil {
+		return stats, err
+	}
+
+	rows, err = db.Query("SELECT referrer, COUNT(*) AS n "+where+" GROUP BY referrer ORDER BY n DESC LIMIT 10", args...)
+	if err != nil {
+		return stats, err
+	}
+	if stats.Referrers, err = scanClickCounts(rows, false, stats.Referrers); err != nil {
+		return stats, err
+	}
+
+	rows, err = db.Query("SELECT agent, COUNT(*) AS n "+where+" GROUP BY agent ORDER BY n DESC", args...)
+	if err != nil {
+		return stats, err
+	}
+	stats.Agents, err = scanClickCounts(rows, false, stats.Agents)
+	return stats, err
+}
+
+func scanClickCounts(rows *sql.Rows, timed bool, counts []ClickCount) ([]ClickCount, error) {
+	defer rows.Close()
+	for rows.Next() {
+		var c ClickCount
+		var name sql.NullString
+		var err error
+		if timed {
+			err = rows.Scan(&c.Time, &c.Count)
+		} else {
+			err = rows.Scan(&name, &c.Count)
+		}
+		if err != nil {
+			return counts, err
+		}
+		c.Name = name.String
+		if !timed && c.Name == "" {
+			c.Name = "direct"
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// handleShortLinkStats returns the click statistics of a short link. The range defaults to the
+// last 30 days, in buckets of a day.
+func handleShortLinkStats(w http.ResponseWriter, r *http.Request, link ShortLink) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := r.URL.Query()
+	to := time.Now().Unix()
+	from := to - 30*24*60*60
+	for param, value := range map[string]*int64{"from": &from, "to": &to} {
+		if v := params.Get(param); v != "" {
+			t, err := parseTime(v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			*value = t
+		}
+	}
+
+	bucket := params.Get("bucket")
+	var size int64
+	switch bucket {
+	case "hour":
+		size = 60 * 60
+	case "", "day":
+		bucket, size = "day", 24*60*60
+	default:
+		http.Error(w, "Invalid bucket, use hour or day", http.StatusBadRequest)
+		return
+	}
+	if (to-from)/size > 10000 {
+		http.Error(w, "Too many buckets, use a larger bucket or a shorter range", http.StatusBadRequest)
+		return
+	}
+
+	stats, err := clickStats(link, from, to, size)
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		return
+	}
+	stats.Bucket = bucket
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// riskyTypes can run scripts when a browser renders them, so they are never served inline.
+var riskyTypes = map[string]bool{
+	"text/html":                true,
+	"application/xhtml+xml":    true,
+	"image/svg+xml":            true,
+	"text/xml":                 true,
+	"application/xml":          true,
+	"text/javascript":          true,
+	"application/javascript":   true,
+	"application/x-javascript": true,
+	"application/ecmascript":   true,
+	"text/ecmascript":          true,
+}
+
+// isRiskyType reports whether a content type can run scripts in a browser.
+func isRiskyType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// Refuse to trust a type we can not parse
+		return true
+	}
+	return riskyTypes[mediaType]
+}
+
+// isGenericType reports whether a sniffed type says little about the file, so the extension may
+// give a better type.
+func isGenericType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "" || mediaType == "application/octet-stream" || mediaType == "text/plain"
+}
+
+// contentTypeAllowed reports whether a content type may be requested with the ct parameter of /get2.
+// Entries of -ct:allow may end in a wildcard, like image/*.
+func contentTypeAllowed(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range strings.Split(*ctAllow, ",") {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed == "" {
+			continue
+		}
+		if ok, _ := path.Match(allowed, mediaType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// typeByExtension returns the content type of an extension, with or without the leading dot.
+func typeByExtension(ext string) string {
+	if ext == "" {
+		return ""
+	}
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// storedType returns the sniffed content type of a file from the database.
+func storedType(id string) (string, error) {
+	var contentType sql.NullString
+	err := db.QueryRow("SELECT type FROM data WHERE id = ?", id).Scan(&contentType)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return contentType.String, err
+}
+
+// setContentHeaders sets the Content-Type and Content-Disposition of a download. Browsers must not
+// guess another type, and risky types are always downloaded instead of rendered.
+func setContentHeaders(w http.ResponseWriter, contentType, filename string, attachment bool) {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	if isRiskyType(contentType) {
+		// Even if a browser renders the file, it runs in a sandbox without scripts or access to the origin
+		w.Header().Set("Content-Security-Policy", "sandbox; default-src 'none'; style-src 'unsafe-inline'")
+		attachment = true
+	}
+	if !attachment {
+		return
+	}
+
+	disposition := "attachment"
+	if filename != "" {
+		disposition = mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+	}
+	w.Header().Set("Content-Disposition", disposition)
+}
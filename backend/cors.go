@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// corsPolicy is the CORS configuration of a group of routes.
+type corsPolicy struct {
+	origins []string
+	methods string
+}
+
+var (
+	// apiCors is used by the public API, like /store and /shorten.
+	apiCors corsPolicy
+	// contentCors is used by the routes serving uploaded files.
+	contentCors corsPolicy
+	// adminCors is used by the admin API.
+	adminCors corsPolicy
+)
+
+// initCors builds the CORS policies of the route groups from the -cors flags.
+func initCors() {
+	apiCors = corsPolicy{origins: splitList(*corsAPI), methods: "POST, GET, OPTIONS, PUT, DELETE"}
+	contentCors = corsPolicy{origins: splitList(*corsContent), methods: "GET, HEAD, OPTIONS"}
+	adminCors = corsPolicy{origins: splitList(*corsAdmin), methods: "POST, GET, OPTIONS, PUT, DELETE"}
+}
+
+// splitList splits a comma separated flag value and drops empty entries.
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// enableCors sets the CORS headers of a response. Only origins allowed by the policy get them,
+// a policy without origins sends no CORS headers at all.
+func enableCors(w *http.ResponseWriter, r *http.Request, policy corsPolicy) {
+	origin := r.Header.Get("Origin")
+	allowed := ""
+	for _, o := range policy.origins {
+		if o == "*" {
+			allowed = "*"
+			break
+		}
+		if origin != "" && strings.EqualFold(o, origin) {
+			allowed = origin
+			break
+		}
+	}
+	if len(policy.origins) > 0 && allowed != "*" {
+		(*w).Header().Add("Vary", "Origin")
+	}
+	if allowed == "" {
+		return
+	}
+
+	(*w).Header().Set("Access-Control-Allow-Origin", allowed)
+	(*w).Header().Set("Access-Control-Allow-Methods", policy.methods)
+	(*w).Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+}
+
+// isContentHost reports whether a request was made to -content:host. If -content:host has no port,
+// the port of the request is ignored.
+func isContentHost(r *http.Request) bool {
+	host := r.Host
+	if !strings.Contains(*contentHost, ":") {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+	}
+	return strings.EqualFold(host, *contentHost)
+}
+
+// contentRoute only serves uploaded files on -content:host, requests to other hosts are redirected
+// there. This keeps uploaded HTML from running on the origin of the API.
+func contentRoute(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if *contentHost != "" && !isContentHost(r) {
+			http.Redirect(w, r, "//"+*contentHost+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// apiRoute refuses requests made to -content:host.
+func apiRoute(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if *contentHost != "" && isContentHost(r) {
+			http.Error(w, "The API is not available on the content host", http.StatusMisdirectedRequest)
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploadChallenge asks a client that declared a file to prove it has it, by hashing a random range
+// of the file after a random nonce. The answer can not be precomputed from the hash alone.
+type uploadChallenge struct {
+	ID     string `json:"challenge"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	Nonce  string `json:"nonce"`
+	// Expires is the unix time the challenge has to be answered by
+	Expires int64 `json:"expires"`
+
+	dataID       string
+	name         string
+	declaredType string
+	owner        string
+	size         int64
+	// ip is the hashed address of the client the challenge was given to
+	ip string
+}
+
+const (
+	challengeTTL    = 5 * time.Minute
+	challengeLength = 64 * 1024
+	// maxChallenges and maxChallengesPerIP limit how many challenges can be waiting for an answer
+	maxChallenges      = 10000
+	maxChallengesPerIP = 20
+)
+
+var errTooManyChallenges = errors.New("too many pending challenges")
+
+var challenges = struct {
+	sync.Mutex
+	m     map[string]*uploadChallenge
+	perIP map[string]int
+}{m: map[string]*uploadChallenge{}, perIP: map[string]int{}}
+
+// addChallenge stores a challenge, unless too many are waiting for an answer in total or from the
+// client it was given to.
+func addChallenge(c *uploadChallenge) error {
+	challenges.Lock()
+	defer challenges.Unlock()
+	if len(challenges.m) >= maxChallenges || challenges.perIP[c.ip] >= maxChallengesPerIP {
+		return errTooManyChallenges
+	}
+	challenges.m[c.ID] = c
+	challenges.perIP[c.ip]++
+	return nil
+}
+
+// removeChallenge forgets a challenge. The caller must hold the lock.
+func removeChallenge(c *uploadChallenge) {
+	delete(challenges.m, c.ID)
+	if challenges.perIP[c.ip]--; challenges.perIP[c.ip] <= 0 {
+		delete(challenges.perIP, c.ip)
+	}
+}
+
+// takeChallenge returns a challenge and removes it, so every challenge can only be answered once.
+func takeChallenge(id string) (*uploadChallenge, bool) {
+	challenges.Lock()
+	defer challenges.Unlock()
+	c, ok := challenges.m[id]
+	if !ok {
+		return nil, false
+	}
+	removeChallenge(c)
+	if c.Expires < time.Now().Unix() {
+		return nil, false
+	}
+	return c, true
+}
+
+// sweepChallenges forgets the challenges that have expired.
+func sweepChallenges() {
+	challenges.Lock()
+	defer challenges.Unlock()
+	now := time.Now().Unix()
+	for _, c := range challenges.m {
+		if c.Expires < now {
+			removeChallenge(c)
+		}
+	}
+}
+
+// expireChallenges sweeps expired challenges every minute.
+func expireChallenges() {
+	for {
+		time.Sleep(time.Minute)
+		sweepChallenges()
+	}
+}
+
+// challengeProof is the answer to a challenge: the hex sha256 of the nonce followed by the range of
+// the file.
+func challengeProof(r io.ReaderAt, c *uploadChallenge) (string, error) {
+	h := sha256.New()
+	h.Write([]byte(c.Nonce))
+	if _, err := io.Copy(h, io.NewSectionReader(r, c.Offset, c.Length)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// storedResponse returns the response /store gives for a file that is already stored.
+func storedResponse(id string) (StoreResponse, error) {
+	response := StoreResponse{SHA256: id}
+	var ahash, dhash, contentType sql.NullString
+	err := db.QueryRow("SELECT sha1, md5, crc32, ahash, dhash, type FROM data WHERE id = ?", id).
+		Scan(&response.SHA1, &response.MD5, &response.CRC32, &ahash, &dhash, &contentType)
+	response.AHash = ahash.String
+	response.DHash = dhash.String
+	response.Type = contentType.String
+	return response, err
+}
+
+// handleDeclare is the first step of uploading by hash. The client declares the sha256 and size of
+// a file, and is either asked to upload it to /store, or given a challenge to prove it has the file
+// if it is already stored.
+func handleDeclare(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w, r, apiCors)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		SHA256 string `json:"sha256"`
+		Size   int64  `json:"size"`
+		Name   string `json:"name"`
+		Type   string `json:"type"`
+		Owner  string `json:"owner"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	request.SHA256 = strings.ToLower(request.SHA256)
+	if !isSHA256(request.SHA256) || request.Size < 0 {
+		http.Error(w, "Invalid sha256 or size", http.StatusBadRequest)
+		return
+	}
+	if request.Size > *maxFileSize {
+		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	blocked, _, err := blockedByID(request.SHA256)
+	if err != nil {
+		http.Error(w, "Failed to check blocklist", http.StatusInternalServerError)
+		return
+	}
+	quarantined, err := isQuarantined(request.SHA256)
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		return
+	}
+	if blocked || quarantined {
+		http.Error(w, "This file has been blocked", http.StatusUnavailableForLegalReasons)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	upload := map[string]string{"status": "upload", "url": baseURL(r) + "/store"}
+
+	// Stored files are stripped, so they never match the hash of a file with metadata
+	if *stripMetadata {
+		json.NewEncoder(w).Encode(upload)
+		return
+	}
+
+	var exists int
+	if err := db.QueryRow("SELECT COUNT(*) FROM data WHERE id = ?", request.SHA256).Scan(&exists); err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		return
+	}
+	var info os.FileInfo
+	path, err := resolveBlob(request.SHA256)
+	if err == nil {
+		info, err = os.Stat(path)
+	}
+	if exists == 0 || err != nil || info.Size() != request.Size {
+		json.NewEncoder(w).Encode(upload)
+		return
+	}
+
+	owner := request.Owner
+	if len(owner) > 255 {
+		owner = owner[:255]
+	}
+	c := &uploadChallenge{
+		ID:           randomHex(16),
+		Nonce:        randomHex(16),
+		Length:       min(request.Size, challengeLength),
+		Expires:      time.Now().Add(challengeTTL).Unix(),
+		dataID:       request.SHA256,
+		name:         cleanFilename(request.Name),
+		declaredType: request.Type,
+		owner:        owner,
+		size:         request.Size,
+		ip:           hashIP(r),
+	}
+	if info.Size() > c.Length {
+		offset, err := rand.Int(rand.Reader, big.NewInt(info.Size()-c.Length+1))
+		if err != nil {
+			panic(err)
+		}
+		c.Offset = offset.Int64()
+	}
+	if err := addChallenge(c); err != nil {
+		http.Error(w, "Too many pending challenges, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	json.NewEncoder(w).Encode(struct {
+		Status string `json:"status"`
+		*uploadChallenge
+	}{"challenge", c})
+}
+
+// handleProve is the second step of uploading by hash. If the proof matches, the upload is recorded
+// as if the file had been uploaded to /store.
+func handleProve(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w, r, apiCors)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Challenge string `json:"challenge"`
+		Proof     string `json:"proof"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	c, ok := takeChallenge(request.Challenge)
+	if !ok {
+		http.Error(w, "Unknown or expired challenge", http.StatusNotFound)
+		return
+	}
+
+	path, err := resolveBlob(c.dataID)
+	if err != nil {
+		http.Error(w, "File not found, upload it to /store", http.StatusNotFound)
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "Failed to open file", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	want, err := challengeProof(file, c)
+	if err != nil {
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		return
+	}
+	if !strings.EqualFold(request.Proof, want) {
+		logLevelln(0, "Failed proof of possession for "+c.dataID)
+		http.Error(w, "Proof does not match", http.StatusForbidden)
+		return
+	}
+
+	response, err := storedResponse(c.dataID)
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		return
+	}
+	err = insertUpload(UploadRecord{DataID: c.dataID, Name: c.name, Size: c.size, DeclaredType: c.declaredType, Type: response.Type, Owner: c.owner}, hashIP(r))
+	if err != nil {
+		logger.Println("Failed to record upload", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
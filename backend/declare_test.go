@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChallengeLimits(t *testing.T) {
+	t.Cleanup(func() {
+		challenges.Lock()
+		challenges.m = map[string]*uploadChallenge{}
+		challenges.perIP = map[string]int{}
+		challenges.Unlock()
+	})
+
+	expires := time.Now().Add(challengeTTL).Unix()
+	for i := 0; i < maxChallengesPerIP; i++ {
+		if err := addChallenge(&uploadChallenge{ID: randomHex(16), Expires: expires, ip: "a"}); err != nil {
+			t.Fatalf("challenge %d: %v", i, err)
+		}
+	}
+	if err := addChallenge(&uploadChallenge{ID: "over", Expires: expires, ip: "a"}); err != errTooManyChallenges {
+		t.Fatalf("challenge over the limit = %v, want %v", err, errTooManyChallenges)
+	}
+	// Other clients are not affected
+	if err := addChallenge(&uploadChallenge{ID: "other", Expires: expires, ip: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	// Answering a challenge makes room for a new one
+	if _, ok := takeChallenge("other"); !ok {
+		t.Fatal("challenge was not found")
+	}
+
+	// Expired challenges are swept and no longer count
+	challenges.Lock()
+	for _, c := range challenges.m {
+		c.Expires = time.Now().Add(-time.Second).Unix()
+	}
+	challenges.Unlock()
+	sweepChallenges()
+	challenges.Lock()
+	n, perIP := len(challenges.m), len(challenges.perIP)
+	challenges.Unlock()
+	if n != 0 || perIP != 0 {
+		t.Errorf("after sweep %d challenges from %d clients are left, want none", n, perIP)
+	}
+	if err := addChallenge(&uploadChallenge{ID: "again", Expires: expires, ip: "a"}); err != nil {
+		t.Errorf("challenge after sweep: %v", err)
+	}
+}
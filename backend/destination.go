@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostResolver looks up the addresses of a host. It is a variable so the DNS lookups can be replaced,
+// for example by a resolver that returns fixed addresses.
+type hostResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+var resolver hostResolver = net.DefaultResolver
+
+var (
+	errSchemeNotAllowed = errors.New("scheme is not allowed")
+	errPrivateHost      = errors.New("host is a private address")
+	errBlockedDomain    = errors.New("domain is blocked")
+
+	// nonPublicNets are the ranges that can not be reached from the internet and are not covered by
+	// the checks of net.IP, like carrier grade NAT, benchmarking and reserved addresses.
+	nonPublicNets = []*net.IPNet{
+		mustParseCIDR("0.0.0.0/8"),
+		mustParseCIDR("100.64.0.0/10"),
+		mustParseCIDR("198.18.0.0/15"),
+		mustParseCIDR("240.0.0.0/4"),
+		mustParseCIDR("64:ff9b:1::/48"),
+	}
+
+	// nat64Prefix and sixToFourPrefix are IPv6 ranges with an IPv4 address inside, which is the
+	// address that is actually reached.
+	nat64Prefix     = mustParseCIDR("64:ff9b::/96")
+	sixToFourPrefix = mustParseCIDR("2002::/16")
+)
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// embeddedIPv4 returns the IPv4 address inside a NAT64 or 6to4 address, or nil.
+func embeddedIPv4(ip net.IP) net.IP {
+	if ip.To4() != nil || len(ip) != net.IPv6len {
+		return nil
+	}
+	switch {
+	case nat64Prefix.Contains(ip):
+		return net.IPv4(ip[12], ip[13], ip[14], ip[15])
+	case sixToFourPrefix.Contains(ip):
+		return net.IPv4(ip[2], ip[3], ip[4], ip[5])
+	}
+	return nil
+}
+
+// isPublicIP reports whether an address can be reached from the internet, and is not private,
+// loopback, link-local, multicast, unspecified or reserved. IPv4 addresses inside IPv6 addresses are
+// checked themselves.
+func isPublicIP(ip net.IP) bool {
+	if v4 := embeddedIPv4(ip); v4 != nil {
+		ip = v4
+	}
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkPublicHost returns errPrivateHost if a host is or resolves to an address that is not public.
+// Every address is checked, since the client could use any of them.
+func checkPublicHost(ctx context.Context, host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		if !isPublicIP(ip) {
+			return errPrivateHost
+		}
+		return nil
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errPrivateHost
+	}
+
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+	for _, addr := range addrs {
+		if !isPublicIP(addr.IP) {
+			return errPrivateHost
+		}
+	}
+	return nil
+}
+
+// checkDestination checks whether a short link may redirect to a URL. The DNS lookup is skipped
+// if resolve is false, so redirects of existing links do not wait for it.
+func checkDestination(target string, resolve bool) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	if !schemeAllowed(u.Scheme) {
+		return errSchemeNotAllowed
+	}
+	if urlDomainBlocked(u) {
+		return errBlockedDomain
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if !resolve || *shortenPrivate {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return checkPublicHost(ctx, host)
+}
+
+func schemeAllowed(scheme string) bool {
+	for _, s := range splitList(*shortenSchemes) {
+		if strings.EqualFold(s, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// domainBlocklist is the list of blocked domains read from -shorten:blocklist.
+var domainBlocklist struct {
+	sync.RWMutex
+	domains  map[string]bool
+	modified time.Time
+}
+
+// domainBlocked reports whether a host or any domain it is a subdomain of is blocked.
+func domainBlocked(host string) bool {
+	domainBlocklist.RLock()
+	defer domainBlocklist.RUnlock()
+	for host != "" {
+		if domainBlocklist.domains[host] {
+			return true
+		}
+		_, host, _ = strings.Cut(host, ".")
+	}
+	return false
+}
+
+// urlDomainBlocked reports whether the host of a URL is blocked.
+func urlDomainBlocked(u *url.URL) bool {
+	return domainBlocked(strings.ToLower(strings.TrimSuffix(u.Hostname(), ".")))
+}
+
+// loadDomainBlocklist reads the domain blocklist if it has changed since it was last read. The file
+// has one domain per line, lines starting with # are ignored.
+func loadDomainBlocklist() error {
+	info, err := os.Stat(*shortenBlocklist)
+	if err != nil {
+		return err
+	}
+	domainBlocklist.RLock()
+	unchanged := info.ModTime().Equal(domainBlocklist.modified)
+	domainBlocklist.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	file, err := os.Open(*shortenBlocklist)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	domains := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domains[strings.TrimSuffix(line, ".")] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	domainBlocklist.Lock()
+	domainBlocklist.domains = domains
+	domainBlocklist.modified = info.ModTime()
+	domainBlocklist.Unlock()
+	logLevelln(0, fmt.Sprintf("Loaded %d blocked domains from %s", len(domains), *shortenBlocklist))
+	return nil
+}
+
+// watchDomainBlocklist reloads the domain blocklist whenever the file changes.
+func watchDomainBlocklist() {
+	for {
+		time.Sleep(10 * time.Second)
+		if err := loadDomainBlocklist(); err != nil {
+			logger.Println("Failed to reload domain blocklist", err)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+// fakeResolver resolves hosts from a fixed table instead of DNS.
+type fakeResolver map[string][]string
+
+func (f fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, ok := f[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	var ips []net.IPAddr
+	for _, a := range addrs {
+		ips = append(ips, net.IPAddr{IP: net.ParseIP(a)})
+	}
+	return ips, nil
+}
+
+// useResolver replaces the resolver for the rest of a test.
+func useResolver(t *testing.T, r hostResolver) {
+	old := resolver
+	resolver = r
+	t.Cleanup(func() { resolver = old })
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"10.0.0.1", false},
+		{"10.255.255.255", false},
+		{"127.0.0.1", false},
+		{"127.1.2.3", false},
+		{"169.254.169.254", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"100.64.0.1", false},
+		{"100.127.255.255", false},
+		{"100.128.0.1", true},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+		{"::1", false},
+		{"::", false},
+		{"fe80::1", false},
+		{"fc00::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+		{"::ffff:93.184.216.34", true},
+		// This network
+		{"0.1.2.3", false},
+		{"0.255.255.255", false},
+		{"1.0.0.1", true},
+		// Benchmarking
+		{"198.18.0.1", false},
+		{"198.19.255.255", false},
+		{"198.17.255.255", true},
+		{"198.20.0.1", true},
+		// Reserved and broadcast
+		{"240.0.0.1", false},
+		{"250.1.2.3", false},
+		{"255.255.255.255", false},
+		{"239.255.255.255", false},
+		{"223.255.255.255", true},
+		// NAT64
+		{"64:ff9b::7f00:1", false},
+		{"64:ff9b::a9fe:a9fe", false},
+		{"64:ff9b::a00:1", false},
+		{"64:ff9b::c612:1", false},
+		{"64:ff9b::5db8:d822", true},
+		{"64:ff9b:1::5db8:d822", false},
+		// 6to4
+		{"2002:7f00:1::1", false},
+		{"2002:a00:1::", false},
+		{"2002:a9fe:a9fe::1", false},
+		{"2002:f000:1::", false},
+		{"2002:5db8:d822::1", true},
+	}
+	for _, tt := range tests {
+		if got := isPublicIP(net.ParseIP(tt.ip)); got != tt.public {
+			t.Errorf("isPublicIP(%s) = %v, want %v", tt.ip, got, tt.public)
+		}
+	}
+}
+
+func TestCheckDestination(t *testing.T) {
+	useResolver(t, fakeResolver{
+		"example.com":       {"93.184.216.34"},
+		"internal.example":  {"10.0.0.5"},
+		"metadata.example":  {"169.254.169.254"},
+		"cgnat.example":     {"100.64.1.1"},
+		"loopback6.example": {"::1"},
+		"mapped.example":    {"::ffff:127.0.0.1"},
+		"mixed.example":     {"93.184.216.34", "127.0.0.1"},
+		"v6.example":        {"2606:2800:220:1:248:1893:25c8:1946"},
+		"nat64.example":     {"64:ff9b::a00:5"},
+	})
+
+	tests := []struct {
+		url string
+		err error
+	}{
+		{"https://example.com/page", nil},
+		{"http://93.184.216.34/", nil},
+		{"https://v6.example/", nil},
+		{"javascript:alert(1)", errSchemeNotAllowed},
+		{"JavaScript:alert(1)", errSchemeNotAllowed},
+		{"data:text/html,<script>alert(1)</script>", errSchemeNotAllowed},
+		{"file:///etc/passwd", errSchemeNotAllowed},
+		{"ftp://example.com/file", errSchemeNotAllowed},
+		{"http://10.1.2.3/", errPrivateHost},
+		{"http://127.0.0.1:8080/", errPrivateHost},
+		{"http://169.254.169.254/latest/meta-data/", errPrivateHost},
+		{"http://100.64.0.1/", errPrivateHost},
+		{"http://[::1]/", errPrivateHost},
+		{"http://[::ffff:127.0.0.1]/", errPrivateHost},
+		{"http://localhost/", errPrivateHost},
+		{"http://app.localhost/", errPrivateHost},
+		{"http://internal.example/", errPrivateHost},
+		{"http://metadata.example/", errPrivateHost},
+		{"http://cgnat.example/", errPrivateHost},
+		{"http://loopback6.example/", errPrivateHost},
+		{"http://mapped.example/", errPrivateHost},
+		{"http://mixed.example/", errPrivateHost},
+		{"http://nat64.example/", errPrivateHost},
+		{"http://[64:ff9b::7f00:1]/", errPrivateHost},
+		{"http://[2002:a9fe:a9fe::1]/", errPrivateHost},
+		{"http://198.18.0.1/", errPrivateHost},
+	}
+	for _, tt := range tests {
+		err := checkDestination(tt.url, true)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("checkDestination(%q) = %v, want %v", tt.url, err, tt.err)
+		}
+	}
+}
+
+func TestCheckDestinationUnresolvable(t *testing.T) {
+	useResolver(t, fakeResolver{})
+	if err := checkDestination("https://missing.example/", true); err == nil {
+		t.Error("checkDestination accepted a host that does not resolve")
+	}
+}
+
+func TestCheckDestinationWithoutResolve(t *testing.T) {
+	// Existing links are checked without a lookup, so the resolver must not be used
+	useResolver(t, fakeResolver{})
+	if err := checkDestination("https://internal.example/", false); err != nil {
+		t.Errorf("checkDestination without resolve = %v, want nil", err)
+	}
+	if err := checkDestination("javascript:alert(1)", false); !errors.Is(err, errSchemeNotAllowed) {
+		t.Errorf("checkDestination without resolve = %v, want %v", err, errSchemeNotAllowed)
+	}
+}
+
+// useDomainBlocklist replaces the domain blocklist for the rest of a test.
+func useDomainBlocklist(t *testing.T, domains ...string) {
+	domainBlocklist.Lock()
+	old := domainBlocklist.domains
+	domainBlocklist.domains = map[string]bool{}
+	for _, d := range domains {
+		domainBlocklist.domains[d] = true
+	}
+	domainBlocklist.Unlock()
+	t.Cleanup(func() {
+		domainBlocklist.Lock()
+		domainBlocklist.domains = old
+		domainBlocklist.Unlock()
+	})
+}
+
+func TestDomainBlocked(t *testing.T) {
+	useDomainBlocklist(t, "bad.example")
+	useResolver(t, fakeResolver{"bad.example": {"93.184.216.34"}, "sub.bad.example": {"93.184.216.34"}, "notbad.example": {"93.184.216.34"}})
+
+	tests := []struct {
+		url string
+		err error
+	}{
+		{"https://bad.example/", errBlockedDomain},
+		{"https://sub.bad.example/", errBlockedDomain},
+		{"https://BAD.example./", errBlockedDomain},
+		{"https://notbad.example/", nil},
+	}
+	for _, tt := range tests {
+		if err := checkDestination(tt.url, true); !errors.Is(err, tt.err) {
+			t.Errorf("checkDestination(%q) = %v, want %v", tt.url, err, tt.err)
+		}
+	}
+}
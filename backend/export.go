@@ -0,0 +1,453 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// An archive made with -export is a tar file, gzipped if its name ends with .gz or .tgz. It starts
+// with manifest.json, followed by every file as blobs/{sha256}, and ends with data.jsonl and
+// urls.jsonl, one row of the data and urls tables per line. The rows come last so they are only
+// imported once the files they describe have been checked.
+const (
+	archiveFormat = 1
+	// schemaVersion is the version of the rows in an archive. Increase it when a column is added to
+	// data or urls.
+	schemaVersion = 1
+)
+
+var errHashMismatch = errors.New("sha256 does not match")
+
+type archiveManifest struct {
+	Format  int    `json:"format"`
+	Schema  int    `json:"schema"`
+	Version string `json:"version"`
+	Created int64  `json:"created"`
+	// Since is the unix time of an incremental export, only files and links added after it are included
+	Since int64 `json:"since,omitempty"`
+}
+
+type archiveFile struct {
+	SHA256   string `json:"sha256"`
+	SHA1     string `json:"sha1"`
+	MD5      string `json:"md5"`
+	CRC32    string `json:"crc32"`
+	AHash    string `json:"ahash,omitempty"`
+	DHash    string `json:"dhash,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Size     int64  `json:"size"`
+	Uploaded int64  `json:"uploaded"`
+}
+
+type archiveLink struct {
+	ShortLink
+	Custom bool `json:"custom"`
+	// Token is the hashed management token of the link
+	Token string `json:"token,omitempty"`
+}
+
+type exportReport struct {
+	Files   int   `json:"files"`
+	Bytes   int64 `json:"bytes"`
+	Missing int   `json:"missing"`
+	Links   int   `json:"links"`
+}
+
+type importReport struct {
+	Files         int `json:"files"`
+	Existing      int `json:"existing"`
+	Corrupt       int `json:"corrupt"`
+	Blocked       int `json:"blocked"`
+	Missing       int `json:"missing"`
+	Links         int `json:"links"`
+	ExistingLinks int `json:"existing_links"`
+}
+
+func printReport(report interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+}
+
+func isGzipName(name string) bool {
+	return strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz")
+}
+
+// writeTarFile adds a file to an archive from a reader of a known size.
+func writeTarFile(tw *tar.Writer, name string, size, modified int64, r io.Reader) error {
+	err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: time.Unix(modified, 0), Typeflag: tar.TypeReg})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, r)
+	return err
+}
+
+// writeTarTemp adds a temporary file to an archive and removes it.
+func writeTarTemp(tw *tar.Writer, name string, tmp *os.File) error {
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	info, err := tmp.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return writeTarFile(tw, name, info.Size(), time.Now().Unix(), tmp)
+}
+
+// runExport writes every stored file and the data and urls tables to the archive given with -export.
+func runExport() {
+	var since int64
+	if *exportSince != "" {
+		var err error
+		if since, err = parseTime(*exportSince); err != nil {
+			log.Fatalf("Invalid -export:since: %v", err)
+		}
+	}
+
+	file, err := os.Create(*exportFile)
+	if err != nil {
+		log.Fatalf("Failed to create archive: %v", err)
+	}
+	defer file.Close()
+	out := bufio.NewWriterSize(file, 1024*1024)
+	var w io.Writer = out
+	var gz *gzip.Writer
+	if isGzipName(*exportFile) {
+		gz = gzip.NewWriter(out)
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+
+	manifest, _ := json.Marshal(archiveManifest{Format: archiveFormat, Schema: schemaVersion, Version: version, Created: time.Now().Unix(), Since: since})
+	if err := writeTarFile(tw, "manifest.json", int64(len(manifest)), time.Now().Unix(), strings.NewReader(string(manifest))); err != nil {
+		log.Fatalf("Failed to write archive: %v", err)
+	}
+
+	report := exportReport{}
+	dataRows, err := os.CreateTemp("", "yapc-data-*.jsonl")
+	if err != nil {
+		log.Fatalf("Failed to create temporary file: %v", err)
+	}
+	// Files are selected by when they were added here, which can be later than their upload time if
+	// they were replicated or imported
+	rows, err := db.Query(`SELECT sha256, sha1, md5, crc32, ahash, dhash, type, uploaded FROM data
+		WHERE id IN (SELECT data_id FROM changes WHERE changed >= ?) AND id NOT IN (SELECT id FROM quarantine)
+		ORDER BY uploaded, id`, since)
+	if err != nil {
+		log.Fatalf("Failed to query database: %v", err)
+	}
+	enc := json.NewEncoder(dataRows)
+	for rows.Next() {
+		var f archiveFile
+		var ahash, dhash, contentType sql.NullString
+		if err := rows.Scan(&f.SHA256, &f.SHA1, &f.MD5, &f.CRC32, &ahash, &dhash, &contentType, &f.Uploaded); err != nil {
+			log.Fatalf("Failed to query database: %v", err)
+		}
+		f.AHash = ahash.String
+		f.DHash = dhash.String
+		f.Type = contentType.String
+
+		path, err := resolveBlob(f.SHA256)
+		if err != nil {
+			logLevelln(0, "Skipping "+f.SHA256+", its data is missing")
+			report.Missing++
+			continue
+		}
+		blob, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("Failed to open %s: %v", path, err)
+		}
+		info, err := blob.Stat()
+		if err == nil {
+			f.Size = info.Size()
+			err = writeTarFile(tw, "blobs/"+f.SHA256, info.Size(), f.Uploaded, blob)
+		}
+		blob.Close()
+		if err != nil {
+			log.Fatalf("Failed to write %s to the archive: %v", f.SHA256, err)
+		}
+
+		enc.Encode(f)
+		report.Files++
+		report.Bytes += f.Size
+		logLevelln(1, "Exported "+f.SHA256)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Fatalf("Failed to query database: %v", err)
+	}
+
+	urlRows, err := os.CreateTemp("", "yapc-urls-*.jsonl")
+	if err != nil {
+		log.Fatalf("Failed to create temporary file: %v", err)
+	}
+	rows, err = db.Query("SELECT id, url, hits, uploaded, custom, expires, max_hits, disabled, token FROM urls WHERE COALESCE(uploaded, 0) >= ? ORDER BY uploaded, id", since)
+	if err != nil {
+		log.Fatalf("Failed to query database: %v", err)
+	}
+	enc = json.NewEncoder(urlRows)
+	enc.SetEscapeHTML(false)
+	for rows.Next() {
+		var l archiveLink
+		var hits, uploaded sql.NullInt64
+		var custom, disabled int
+		var token sql.NullString
+		if err := rows.Scan(&l.ID, &l.URL, &hits, &uploaded, &custom, &l.Expires, &l.MaxHits, &disabled, &token); err != nil {
+			log.Fatalf("Failed to query database: %v", err)
+		}
+		l.Hits = hits.Int64
+		l.Uploaded = uploaded.Int64
+		l.Custom = custom == 1
+		l.Disabled = disabled == 1
+		l.Token = token.String
+		enc.Encode(l)
+		report.Links++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Fatalf("Failed to query database: %v", err)
+	}
+
+	if err := writeTarTemp(tw, "data.jsonl", dataRows); err != nil {
+		log.Fatalf("Failed to write archive: %v", err)
+	}
+	if err := writeTarTemp(tw, "urls.jsonl", urlRows); err != nil {
+		log.Fatalf("Failed to write archive: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		log.Fatalf("Failed to write archive: %v", err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			log.Fatalf("Failed to write archive: %v", err)
+		}
+	}
+	if err := out.Flush(); err != nil {
+		log.Fatalf("Failed to write archive: %v", err)
+	}
+	printReport(report)
+}
+
+// runImport reads an archive made with -export. Every file is hashed and only stored if it matches
+// its name and is not blocked, and rows are only inserted if their file was stored and matches their
+// hashes. Files and links that already exist are left alone.
+func runImport() {
+	file, err := os.Open(*importFile)
+	if err != nil {
+		log.Fatalf("Failed to open archive: %v", err)
+	}
+	defer file.Close()
+	in := bufio.NewReaderSize(file, 1024*1024)
+	var r io.Reader = in
+	if magic, _ := in.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			log.Fatalf("Failed to read archive: %v", err)
+		}
+		r = gz
+	}
+	tr := tar.NewReader(r)
+
+	report := importReport{}
+	// The files in the archive that were checked, nil for files that are already known
+	files := map[string]*importedFile{}
+	var manifest *archiveManifest
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalf("Failed to read archive: %v", err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+		if manifest == nil && hdr.Name != "manifest.json" {
+			log.Fatal("Not a yapc archive, it does not start with manifest.json")
+		}
+
+		switch {
+		case hdr.Name == "manifest.json":
+			manifest = &archiveManifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				log.Fatalf("Failed to read manifest: %v", err)
+			}
+			if manifest.Format != archiveFormat || manifest.Schema > schemaVersion {
+				log.Fatalf("The archive was made by yapc %s and can not be imported by this version", manifest.Version)
+			}
+		case strings.HasPrefix(hdr.Name, "blobs/"):
+			id := strings.TrimPrefix(hdr.Name, "blobs/")
+			if !isSHA256(id) {
+				logLevelln(0, "Skipping "+hdr.Name+", it is not named after a sha256")
+				continue
+			}
+			f, err := importBlob(id, tr)
+			switch {
+			case err == errHashMismatch:
+				logLevelln(0, "Skipping "+id+", its sha256 does not match")
+				report.Corrupt++
+				continue
+			case err == errBlocked:
+				logLevelln(0, "Skipping "+id+", it is blocked")
+				report.Blocked++
+				continue
+			case err != nil:
+				log.Fatalf("Failed to import %s: %v", id, err)
+			}
+			files[id] = f
+		case hdr.Name == "data.jsonl":
+			importDataRows(tr, files, &report)
+		case hdr.Name == "urls.jsonl":
+			importLinks(tr, &report)
+		default:
+			logLevelln(0, "Skipping unknown archive entry "+hdr.Name)
+		}
+	}
+
+	// Files without a row can not be served, so they are not kept
+	for id, f := range files {
+		if f != nil && f.path != "" {
+			os.Remove(f.path)
+			logLevelln(0, "Removed "+id+", the archive has no row for it")
+			report.Missing++
+		}
+	}
+	printReport(report)
+}
+
+// importedFile is a file read from an archive, with the hashes and type computed from its data.
+type importedFile struct {
+	hashes      map[string]string
+	contentType string
+	size        int64
+	// path is where the file was stored by this import, empty if it was already on disk
+	path string
+}
+
+// importBlob hashes a file from an archive like storeBlob does, and stores it if it matches its name
+// and is not blocked. Files that are already known, including quarantined files, are skipped.
+func importBlob(id string, r io.Reader) (*importedFile, error) {
+	var exists int
+	if err := db.QueryRow("SELECT COUNT(*) FROM data WHERE id = ?", id).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists > 0 {
+		_, err := io.Copy(io.Discard, r)
+		return nil, err
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	hashes, contentType := computeHashes(data)
+	if hashes["sha256"] != id {
+		return nil, errHashMismatch
+	}
+	blocked, _, err := checkBlocked(hashes)
+	if err != nil {
+		return nil, err
+	}
+	if blocked {
+		return nil, errBlocked
+	}
+
+	f := &importedFile{hashes: hashes, contentType: contentType, size: int64(len(data))}
+	if _, err := resolveBlob(id); err == nil {
+		return f, nil
+	}
+	if f.path, err = prepareBlobPath(id); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(f.path, data, 0644); err != nil {
+		os.Remove(f.path)
+		return nil, err
+	}
+	return f, nil
+}
+
+// importDataRows inserts the rows of data.jsonl whose file was in the archive. Only the upload time
+// is taken from the row, the hashes and type are those computed from the file.
+func importDataRows(r io.Reader, files map[string]*importedFile, report *importReport) {
+	dec := json.NewDecoder(r)
+	for {
+		var row archiveFile
+		if err := dec.Decode(&row); err == io.EOF {
+			return
+		} else if err != nil {
+			log.Fatalf("Failed to read data.jsonl: %v", err)
+		}
+
+		f, ok := files[row.SHA256]
+		if !ok {
+			continue
+		}
+		delete(files, row.SHA256)
+		if f == nil {
+			report.Existing++
+			continue
+		}
+
+		if f.hashes["sha1"] != row.SHA1 || f.hashes["md5"] != row.MD5 || f.hashes["crc32"] != row.CRC32 {
+			logLevelln(0, "Skipping "+row.SHA256+", its hashes do not match the file")
+			report.Corrupt++
+			if f.path != "" {
+				os.Remove(f.path)
+			}
+			continue
+		}
+
+		if err := insertData(f.hashes, f.contentType, f.size, row.Uploaded); err != nil {
+			log.Fatalf("Failed to insert %s: %v", row.SHA256, err)
+		}
+		report.Files++
+		logLevelln(1, "Imported "+row.SHA256)
+	}
+}
+
+// importLinks inserts the short links of urls.jsonl whose id is not taken.
+func importLinks(r io.Reader, report *importReport) {
+	dec := json.NewDecoder(r)
+	for {
+		var l archiveLink
+		if err := dec.Decode(&l); err == io.EOF {
+			return
+		} else if err != nil {
+			log.Fatalf("Failed to read urls.jsonl: %v", err)
+		}
+
+		var exists int
+		if err := db.QueryRow("SELECT COUNT(*) FROM urls WHERE id = ?", l.ID).Scan(&exists); err != nil {
+			log.Fatalf("Failed to query database: %v", err)
+		}
+		if exists > 0 {
+			report.ExistingLinks++
+			continue
+		}
+
+		var token interface{}
+		if l.Token != "" {
+			token = l.Token
+		}
+		_, err := db.Exec("INSERT INTO urls (id, url, hits, uploaded, custom, expires, max_hits, disabled, token) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			l.ID, l.URL, l.Hits, l.Uploaded, boolInt(l.Custom), l.Expires, l.MaxHits, boolInt(l.Disabled), token)
+		if err != nil {
+			log.Fatalf("Failed to insert short link %s: %v", l.ID, err)
+		}
+		report.Links++
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/hexahigh/yapc/backend/lib/strip"
+)
+
+// fetchQueue holds the ids of fetches waiting for a worker.
+var fetchQueue = make(chan string, 1000)
+
+// fetchClient downloads remote files. It connects only to public addresses unless -fetch:private is
+// set, checking the address it actually dials so DNS can not point it somewhere else after the check.
+// Proxies from the environment are not used, since they would connect on our behalf.
+var fetchClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 nil,
+		DialContext:           publicDialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) > *fetchRedirects {
+			return errors.New("too many redirects")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return errSchemeNotAllowed
+		}
+		if urlDomainBlocked(req.URL) {
+			return errBlockedDomain
+		}
+		return nil
+	},
+}
+
+// publicDialContext dials the first public address of a host.
+func publicDialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+
+	var dialer net.Dialer
+	lastErr := errPrivateHost
+	for _, ip := range ips {
+		if !*fetchPrivate && !isPublicIP(ip) {
+			continue
+		}
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// startFetchWorkers starts the workers that run fetches, and queues the fetches that were not
+// finished when the server stopped.
+func startFetchWorkers() {
+	for i := 0; i < max(*fetchWorkers, 1); i++ {
+		go func() {
+			for id := range fetchQueue {
+				runFetch(id)
+			}
+		}()
+	}
+
+	rows, err := db.Query("SELECT id FROM fetches WHERE status = 'queued' OR status = 'running' ORDER BY created")
+	if err != nil {
+		logger.Println("Failed to load fetches:", err)
+		return
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if rows.Scan(&id) == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	// The queue may be smaller than the backlog, so queue them without holding up the server
+	go func() {
+		for _, id := range ids {
+			logLevelln(0, "Resuming fetch "+id)
+			fetchQueue <- id
+		}
+	}()
+}
+
+func loadFetch(id string) (FetchJob, error) {
+	var f FetchJob
+	var fetchErr, name, sha256Hash, contentType, owner, ipHash sql.NullString
+	var size sql.NullInt64
+	var stripFile int
+	err := db.QueryRow("SELECT id, url, status, error, name, sha256, type, size, owner, ip_hash, strip, created, finished FROM fetches WHERE id = ?", id).
+		Scan(&f.ID, &f.URL, &f.Status, &fetchErr, &name, &sha256Hash, &contentType, &size, &owner, &ipHash, &stripFile, &f.Created, &f.Finished)
+	f.Error = fetchErr.String
+	f.Name = name.String
+	f.SHA256 = sha256Hash.String
+	f.Type = contentType.String
+	f.Size = size.Int64
+	f.owner = owner.String
+	f.ipHash = ipHash.String
+	f.strip = stripFile == 1
+	return f, err
+}
+
+func saveFetch(f FetchJob) {
+	_, err := db.Exec("UPDATE fetches SET status = ?, error = ?, name = ?, sha256 = ?, type = ?, size = ?, finished = ? WHERE id = ?",
+		f.Status, f.Error, f.Name, f.SHA256, f.Type, f.Size, f.Finished, f.ID)
+	if err != nil {
+		logger.Printf("Failed to save fetch %s: %v", f.ID, err)
+	}
+}
+
+// runFetch downloads a queued fetch and stores it like an upload to /store.
+func runFetch(id string) {
+	f, err := loadFetch(id)
+	if err != nil {
+		logger.Printf("Failed to load fetch %s: %v", id, err)
+		return
+	}
+	f.Status = "running"
+	saveFetch(f)
+
+	if err := downloadFetch(&f); err != nil {
+		f.Status = "failed"
+		f.Error = err.Error()
+		logLevelln(1, "Fetch "+f.ID+" failed: "+f.Error)
+	} else {
+		f.Status = "done"
+		logLevelln(1, "Fetched "+f.URL+" as "+f.SHA256)
+	}
+	f.Finished = time.Now().Unix()
+	saveFetch(f)
+}
+
+func downloadFetch(f *FetchJob) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *fetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "yapc/"+version)
+	// The blocklist may have changed since the fetch was queued
+	if urlDomainBlocked(req.URL) {
+		return errors.New("this domain is blocked")
+	}
+
+	resp, err := fetchClient.Do(req)
+	if errors.Is(err, errBlockedDomain) {
+		return errors.New("url redirects to a blocked domain")
+	}
+	if errors.Is(err, errPrivateHost) || errors.Is(err, errSchemeNotAllowed) {
+		return errors.New("url points to a private address or unsupported scheme")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("remote server responded with %s", resp.Status)
+	}
+	limit := min(*fetchMaxSize, *maxFileSize)
+	if resp.ContentLength > limit {
+		return errors.New("file too large")
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return fmt.Errorf("failed to download: %v", err)
+	}
+	if int64(len(data)) > limit {
+		return errors.New("file too large")
+	}
+
+	// Use the filename the server gives, or the last part of the URL after redirects
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		f.Name = cleanFilename(params["filename"])
+	} else if name := path.Base(resp.Request.URL.Path); name != "/" && name != "." {
+		f.Name = cleanFilename(name)
+	}
+
+	size := int64(len(data))
+	if (*stripMetadata || f.strip) && strip.Supported(data) {
+		if size > *stripMaxSize {
+			return errors.New("image is too large to strip metadata from")
+		}
+		if data, _, err = strip.Metadata(data); err != nil {
+			return errors.New("failed to strip metadata")
+		}
+	}
+
+	hashes, contentType, _, err := storeBlob(data)
+	if err == errBlocked {
+		return errors.New("this file has been blocked")
+	}
+	if err != nil {
+		logger.Println("Failed to store fetched file", err)
+		return errors.New("failed to store file")
+	}
+
+	f.SHA256 = hashes["sha256"]
+	f.Type = contentType
+	f.Size = int64(len(data))
+	err = insertUpload(UploadRecord{DataID: f.SHA256, Name: f.Name, Size: size, DeclaredType: resp.Header.Get("Content-Type"), Type: contentType, Owner: f.owner}, f.ipHash)
+	if err != nil {
+		logger.Println("Failed to record upload", err)
+	}
+	return nil
+}
+
+// handleFetch starts downloading a remote URL into storage and returns the fetch to poll with /fetch/{id}.
+func handleFetch(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w, r, apiCors)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		URL   string `json:"url"`
+		Owner string `json:"owner"`
+		Strip bool   `json:"strip"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	u, err := url.Parse(request.URL)
+	if err != nil || len(request.URL) > 2048 || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, "Invalid url, use an http or https url", http.StatusBadRequest)
+		return
+	}
+	if urlDomainBlocked(u) {
+		http.Error(w, "This domain is blocked", http.StatusForbidden)
+		return
+	}
+	if len(request.Owner) > 255 {
+		request.Owner = request.Owner[:255]
+	}
+
+	f := FetchJob{ID: randomHex(16), URL: request.URL, Status: "queued", Created: time.Now().Unix()}
+	_, err = db.Exec("INSERT INTO fetches (id, url, status, owner, ip_hash, strip, created, finished) VALUES (?, ?, ?, ?, ?, ?, ?, 0)",
+		f.ID, f.URL, f.Status, request.Owner, hashIP(r), boolInt(request.Strip), f.Created)
+	if err != nil {
+		http.Error(w, "Failed to queue fetch", http.StatusInternalServerError)
+		return
+	}
+
+	select {
+	case fetchQueue <- f.ID:
+	default:
+		db.Exec("DELETE FROM fetches WHERE id = ?", f.ID)
+		http.Error(w, "Too many fetches are queued, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/fetch/"+f.ID)
+	w.WriteHeader(http.StatusAccepted)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(f)
+}
+
+// handleFetchStatus returns the status of a fetch, and the hashes of the file once it is done.
+func handleFetchStatus(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w, r, apiCors)
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	f, err := loadFetch(strings.TrimPrefix(r.URL.Path, "/fetch/"))
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(f)
+}
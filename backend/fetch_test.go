@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fetchServer serves test files for /fetch. Most tests allow private addresses, since the test
+// server listens on loopback.
+func fetchServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello from the test server"))
+	})
+	mux.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="report.txt"`)
+		w.Write([]byte("a report"))
+	})
+	mux.HandleFunc("/sneaky", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="../../etc/passwd"`)
+		w.Write([]byte("not a password file"))
+	})
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("a"), 2048))
+	})
+	mux.HandleFunc("/big-chunked", func(w http.ResponseWriter, r *http.Request) {
+		// Flushing before the end sends the body without a Content-Length
+		for i := 0; i < 4; i++ {
+			w.Write(bytes.Repeat([]byte("b"), 512))
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/to", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, r.URL.Query().Get("url"), http.StatusFound)
+	})
+	// /redirect/{n} redirects n times before ending at /file.txt
+	mux.HandleFunc("/redirect/", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/redirect/"))
+		if n <= 0 {
+			http.Redirect(w, r, "/file.txt", http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/redirect/%d", n-1), http.StatusFound)
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDownloadFetch(t *testing.T) {
+	setupTestDB(t)
+	setFlag(t, fetchPrivate, true)
+	srv := fetchServer(t)
+
+	f := FetchJob{ID: "test", URL: srv.URL + "/file.txt"}
+	if err := downloadFetch(&f); err != nil {
+		t.Fatalf("downloadFetch = %v", err)
+	}
+	sum := sha256.Sum256([]byte("hello from the test server"))
+	if f.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("sha256 = %s, want %s", f.SHA256, hex.EncodeToString(sum[:]))
+	}
+	if f.Name != "file.txt" {
+		t.Errorf("name = %q, want %q", f.Name, "file.txt")
+	}
+	if _, err := resolveBlob(f.SHA256); err != nil {
+		t.Errorf("fetched file was not stored: %v", err)
+	}
+}
+
+func TestDownloadFetchName(t *testing.T) {
+	setupTestDB(t)
+	setFlag(t, fetchPrivate, true)
+	srv := fetchServer(t)
+
+	tests := []struct {
+		path string
+		name string
+	}{
+		{"/download", "report.txt"},
+		{"/sneaky", "passwd"},
+		{"/redirect/1", "file.txt"},
+	}
+	for _, tt := range tests {
+		f := FetchJob{ID: "test", URL: srv.URL + tt.path}
+		if err := downloadFetch(&f); err != nil {
+			t.Errorf("downloadFetch(%s) = %v", tt.path, err)
+			continue
+		}
+		if f.Name != tt.name {
+			t.Errorf("downloadFetch(%s) name = %q, want %q", tt.path, f.Name, tt.name)
+		}
+	}
+}
+
+func TestDownloadFetchErrors(t *testing.T) {
+	setupTestDB(t)
+	setFlag(t, fetchPrivate, true)
+	setFlag(t, fetchMaxSize, 1024)
+	setFlag(t, fetchRedirects, 2)
+	setFlag(t, fetchTimeout, 200*time.Millisecond)
+	srv := fetchServer(t)
+
+	tests := []struct {
+		path string
+		err  string
+	}{
+		{"/big", "file too large"},
+		{"/big-chunked", "file too large"},
+		{"/redirect/1", ""},
+		{"/redirect/2", "too many redirects"},
+		{"/redirect/5", "too many redirects"},
+		{"/slow", "deadline exceeded"},
+		{"/missing", "404 Not Found"},
+	}
+	for _, tt := range tests {
+		f := FetchJob{ID: "test", URL: srv.URL + tt.path}
+		err := downloadFetch(&f)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("downloadFetch(%s) = %v, want nil", tt.path, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("downloadFetch(%s) = %v, want an error containing %q", tt.path, err, tt.err)
+		}
+	}
+}
+
+func TestDownloadFetchPrivate(t *testing.T) {
+	setupTestDB(t)
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Write([]byte("internal"))
+	}))
+	t.Cleanup(srv.Close)
+
+	// The test server listens on loopback, so without -fetch:private it must not be reached
+	useResolver(t, fakeResolver{"localhost": {"127.0.0.1"}})
+	for _, u := range []string{srv.URL, strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)} {
+		f := FetchJob{ID: "test", URL: u}
+		err := downloadFetch(&f)
+		if err == nil || !strings.Contains(err.Error(), "private address") {
+			t.Errorf("downloadFetch(%s) = %v, want a private address error", u, err)
+		}
+	}
+	if n := hits.Load(); n != 0 {
+		t.Errorf("test server was reached %d times", n)
+	}
+}
+
+func TestDownloadFetchBlockedDomain(t *testing.T) {
+	setupTestDB(t)
+	setFlag(t, fetchPrivate, true)
+	useDomainBlocklist(t, "blocked.example")
+	srv := fetchServer(t)
+	port := srv.URL[strings.LastIndex(srv.URL, ":")+1:]
+	useResolver(t, fakeResolver{"blocked.example": {"127.0.0.1"}, "cdn.blocked.example": {"127.0.0.1"}, "fine.example": {"127.0.0.1"}})
+
+	body, _ := json.Marshal(map[string]string{"url": "http://cdn.blocked.example:" + port + "/file.txt"})
+	w := httptest.NewRecorder()
+	handleFetch(w, httptest.NewRequest(http.MethodPost, "/fetch", bytes.NewReader(body)))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("POST /fetch of a blocked domain = %d, want 403", w.Code)
+	}
+
+	// A domain blocked after the fetch was queued, and a redirect to a blocked domain
+	f := FetchJob{ID: "test", URL: "http://blocked.example:" + port + "/file.txt"}
+	if err := downloadFetch(&f); err == nil || !strings.Contains(err.Error(), "blocked") {
+		t.Errorf("downloadFetch of a blocked domain = %v, want a blocked domain error", err)
+	}
+	redirect := srv.URL + "/to?url=" + url.QueryEscape("http://blocked.example:"+port+"/file.txt")
+	f = FetchJob{ID: "test", URL: redirect}
+	if err := downloadFetch(&f); err == nil || !strings.Contains(err.Error(), "blocked") {
+		t.Errorf("downloadFetch redirected to a blocked domain = %v, want a blocked domain error", err)
+	}
+	f = FetchJob{ID: "test", URL: srv.URL + "/to?url=" + url.QueryEscape("http://fine.example:"+port+"/file.txt")}
+	if err := downloadFetch(&f); err != nil {
+		t.Errorf("downloadFetch redirected to an allowed domain = %v", err)
+	}
+}
+
+func TestFetchJob(t *testing.T) {
+	setupTestDB(t)
+	setFlag(t, fetchPrivate, true)
+	srv := fetchServer(t)
+
+	body, _ := json.Marshal(map[string]string{"url": srv.URL + "/download", "owner": "tester"})
+	w := httptest.NewRecorder()
+	handleFetch(w, httptest.NewRequest(http.MethodPost, "/fetch", bytes.NewReader(body)))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("POST /fetch = %d %s", w.Code, w.Body.String())
+	}
+	var queued FetchJob
+	if err := json.NewDecoder(w.Body).Decode(&queued); err != nil {
+		t.Fatal(err)
+	}
+	if w.Header().Get("Location") != "/fetch/"+queued.ID {
+		t.Errorf("Location = %q, want %q", w.Header().Get("Location"), "/fetch/"+queued.ID)
+	}
+	// No workers run in tests, so take the fetch off the queue and run it here
+	<-fetchQueue
+	runFetch(queued.ID)
+
+	w = httptest.NewRecorder()
+	handleFetchStatus(w, httptest.NewRequest(http.MethodGet, "/fetch/"+queued.ID, nil))
+	var done FetchJob
+	if err := json.NewDecoder(w.Body).Decode(&done); err != nil {
+		t.Fatal(err)
+	}
+	if done.Status != "done" || done.Name != "report.txt" || done.SHA256 == "" {
+		t.Errorf("fetch = %+v, want a done fetch of report.txt", done)
+	}
+
+	var owner string
+	if err := db.QueryRow("SELECT owner FROM uploads WHERE data_id = ?", done.SHA256).Scan(&owner); err != nil || owner != "tester" {
+		t.Errorf("upload owner = %q, %v, want %q", owner, err, "tester")
+	}
+}
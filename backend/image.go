@@ -0,0 +1,339 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+// ImageOptions are the parameters of /img.
+type ImageOptions struct {
+	Width   int
+	Height  int
+	Fit     string
+	Quality int
+	Format  string
+}
+
+// key returns the cache key of a transformed image.
+func (o ImageOptions) key(id string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%d:%d:%s:%d:%s", id, o.Width, o.Height, o.Fit, o.Quality, o.Format)))
+	return hex.EncodeToString(sum[:])
+}
+
+// imageMaxAge is how long browsers and shared caches may keep a transformed image. The image of a
+// hash never changes, but it has to stop being served once the file is blocked.
+const imageMaxAge = time.Hour
+
+var (
+	// imageCacheSize is the size of the image cache in bytes, it is only exact after trimImageCache.
+	imageCacheSize int64
+	imageCacheMu   sync.Mutex
+)
+
+// imageCacheDir returns the folder transformed images are cached in. It is hidden so the scrubber
+// does not see the cached images as orphans.
+func imageCacheDir() string {
+	return filepath.Join(*dataDir, ".cache", "img")
+}
+
+// imageCachePath returns where a transformed image is cached. The images of a file share a folder,
+// so they can be removed together when the file is.
+func imageCachePath(id string, o ImageOptions) string {
+	return filepath.Join(imageCacheDir(), id[:2], id, o.key(id))
+}
+
+// purgeImageCache removes every cached transform of a file.
+func purgeImageCache(id string) error {
+	if len(id) < 2 {
+		return nil
+	}
+	return os.RemoveAll(filepath.Join(imageCacheDir(), id[:2], id))
+}
+
+// parseImageOptions reads and validates the parameters of /img.
+func parseImageOptions(r *http.Request) (ImageOptions, error) {
+	params := r.URL.Query()
+	o := ImageOptions{
+		Fit:     params.Get("fit"),
+		Format:  strings.ToLower(params.Get("format")),
+		Quality: 85,
+	}
+
+	var err error
+	if v := params.Get("w"); v != "" {
+		if o.Width, err = strconv.Atoi(v); err != nil || o.Width < 0 || o.Width > *imgMaxSize {
+			return o, fmt.Errorf("width must be between 0 and %d", *imgMaxSize)
+		}
+	}
+	if v := params.Get("h"); v != "" {
+		if o.Height, err = strconv.Atoi(v); err != nil || o.Height < 0 || o.Height > *imgMaxSize {
+			return o, fmt.Errorf("height must be between 0 and %d", *imgMaxSize)
+		}
+	}
+	if v := params.Get("q"); v != "" {
+		if o.Quality, err = strconv.Atoi(v); err != nil || o.Quality < 1 || o.Quality > 100 {
+			return o, fmt.Errorf("quality must be between 1 and 100")
+		}
+	}
+
+	switch o.Fit {
+	case "":
+		o.Fit = "contain"
+	case "contain", "cover", "fill":
+	default:
+		return o, fmt.Errorf("fit must be contain, cover or fill")
+	}
+
+	switch o.Format {
+	case "", "png":
+	case "jpeg", "jpg":
+		o.Format = "jpeg"
+	default:
+		return o, fmt.Errorf("format must be png or jpeg")
+	}
+
+	return o, nil
+}
+
+// transformImage resizes an image. contain keeps the aspect ratio and fits the image inside the
+// size, cover crops it to fill the size and fill stretches it. Images are never enlarged by contain.
+func transformImage(img image.Image, o ImageOptions) image.Image {
+	if o.Width == 0 && o.Height == 0 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	if o.Width == 0 || o.Height == 0 {
+		// With only one side the aspect ratio is kept, whatever the fit is
+		if (o.Width == 0 || o.Width >= bounds.Dx()) && (o.Height == 0 || o.Height >= bounds.Dy()) {
+			return img
+		}
+		return imaging.Resize(img, o.Width, o.Height, imaging.Lanczos)
+	}
+
+	switch o.Fit {
+	case "cover":
+		return imaging.Fill(img, o.Width, o.Height, imaging.Center, imaging.Lanczos)
+	case "fill":
+		return imaging.Resize(img, o.Width, o.Height, imaging.Lanczos)
+	default:
+		return imaging.Fit(img, o.Width, o.Height, imaging.Lanczos)
+	}
+}
+
+// renderImage decodes a stored image, rotates it according to its EXIF orientation, transforms it
+// and writes the result to the cache.
+func renderImage(id, cachePath string, o ImageOptions) error {
+	srcPath, err := resolveBlob(id)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Check the size before decoding, so small files can not make us allocate huge images
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return err
+	}
+	if int64(config.Width)*int64(config.Height) > *imgMaxPixels {
+		return fmt.Errorf("image is too large to transform")
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		return err
+	}
+
+	img, err := imaging.Decode(file, imaging.AutoOrientation(true))
+	if err != nil {
+		return err
+	}
+	img = transformImage(img, o)
+
+	outFormat := imaging.PNG
+	if o.Format == "jpeg" {
+		outFormat = imaging.JPEG
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(cachePath), ".img-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = imaging.Encode(tmp, img, outFormat, imaging.JPEGQuality(o.Quality))
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), cachePath); err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(cachePath); err == nil {
+		if atomic.AddInt64(&imageCacheSize, info.Size()) > *imgCacheLimit {
+			go trimImageCache()
+		}
+	}
+	return nil
+}
+
+// trimImageCache deletes the least recently used images until the cache is below 90% of
+// -img:cache. It also recounts the size of the cache.
+func trimImageCache() {
+	if !imageCacheMu.TryLock() {
+		return
+	}
+	defer imageCacheMu.Unlock()
+
+	type cached struct {
+		path string
+		size int64
+		used int64
+	}
+	var files []cached
+	var total int64
+	filepath.WalkDir(imageCacheDir(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files = append(files, cached{path, info.Size(), info.ModTime().UnixNano()})
+		total += info.Size()
+		return nil
+	})
+
+	limit := *imgCacheLimit / 10 * 9
+	if total > limit {
+		sort.Slice(files, func(i, j int) bool { return files[i].used < files[j].used })
+		for _, file := range files {
+			if total <= limit {
+				break
+			}
+			if err := os.Remove(file.path); err == nil {
+				total -= file.size
+			}
+		}
+		logLevelln(1, fmt.Sprintf("Trimmed image cache to %d bytes", total))
+	}
+	atomic.StoreInt64(&imageCacheSize, total)
+}
+
+func handleImage(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&downloadCount, 1)
+	defer atomic.AddInt64(&downloadCount, -1)
+
+	enableCors(&w, r, contentCors)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if !requireSignature(w, r) {
+		return
+	}
+
+	id := r.URL.Path[len("/img/"):]
+	if !isSHA256(id) {
+		http.Error(w, "Invalid hash", http.StatusBadRequest)
+		return
+	}
+
+	o, err := parseImageOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	blocked, _, err := blockedByID(id)
+	if err != nil {
+		http.Error(w, "Failed to check blocklist", http.StatusInternalServerError)
+		return
+	}
+	if blocked {
+		http.Error(w, "This file has been blocked", http.StatusUnavailableForLegalReasons)
+		return
+	}
+
+	// The database entry of a quarantined file is kept, but its images must not be served
+	quarantined, err := isQuarantined(id)
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		return
+	}
+	if _, err := resolveBlob(id); err != nil || quarantined {
+		http.NotFound(w, r)
+		return
+	}
+
+	contentType, err := storedType(id)
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		return
+	}
+	if contentType == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !isHashableImage(contentType) && contentType != "image/webp" {
+		http.Error(w, "File is not an image", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// Keep the format of JPEG images, anything else becomes a PNG
+	if o.Format == "" {
+		o.Format = "png"
+		if contentType == "image/jpeg" {
+			o.Format = "jpeg"
+		}
+	}
+
+	cachePath := imageCachePath(id, o)
+	if _, err := os.Stat(cachePath); err != nil {
+		if err := renderImage(id, cachePath, o); err != nil {
+			if os.IsNotExist(err) {
+				http.NotFound(w, r)
+				return
+			}
+			logger.Println("Failed to transform image", id, err)
+			http.Error(w, "Failed to transform image", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	file, err := os.Open(cachePath)
+	if err != nil {
+		http.Error(w, "Failed to open image", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	// Mark the image as recently used for trimImageCache
+	now := time.Now()
+	os.Chtimes(cachePath, now, now)
+
+	setContentHeaders(w, "image/"+o.Format, "", false)
+	w.Header().Set("Cache-Control", cacheControl(r, imageMaxAge))
+	http.ServeContent(w, r, "", time.Time{}, file)
+}
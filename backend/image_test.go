@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storeTestImage stores a small PNG and returns its sha256.
+func storeTestImage(t *testing.T) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 16, 16))); err != nil {
+		t.Fatal(err)
+	}
+	hashes, _, _, err := storeBlob(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hashes["sha256"]
+}
+
+func TestImageCacheControl(t *testing.T) {
+	setupTestDB(t)
+	id := storeTestImage(t)
+
+	w := get(handleImage, "/img/"+id+"?w=8")
+	if w.Code != http.StatusOK {
+		t.Fatalf("/img = %d %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Cache-Control"); got != "public, max-age=3600" {
+		t.Errorf("Cache-Control = %q, want %q", got, "public, max-age=3600")
+	}
+
+	// A signed image is private and is not kept past the expiry of its link
+	setFlag(t, signKey, "secret")
+	w = get(handleImage, signURL("/img/"+id, url.Values{"w": {"8"}}, time.Now().Add(10*time.Minute)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("signed /img = %d %s", w.Code, w.Body.String())
+	}
+	got := w.Header().Get("Cache-Control")
+	maxAge, err := strconv.Atoi(strings.TrimPrefix(got, "private, max-age="))
+	if !strings.HasPrefix(got, "private, max-age=") || err != nil || maxAge > 600 || maxAge < 590 {
+		t.Errorf("signed Cache-Control = %q, want private until the link expires", got)
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	setFlag(t, signKey, "")
+	now := time.Now()
+	tests := []struct {
+		key  string
+		url  string
+		want string
+	}{
+		{"", "/img/x", "public, max-age=3600"},
+		{"secret", "/img/x", "private, max-age=3600"},
+		{"secret", "/img/x?sig=a&exp=" + strconv.FormatInt(now.Add(2*time.Hour).Unix(), 10), "private, max-age=3600"},
+		{"secret", "/img/x?sig=a&exp=" + strconv.FormatInt(now.Add(-time.Minute).Unix(), 10), "private, no-store"},
+		{"secret", "/img/x?sig=a&exp=soon", "private, no-store"},
+	}
+	for _, tt := range tests {
+		*signKey = tt.key
+		r, _ := http.NewRequest(http.MethodGet, tt.url, nil)
+		if got := cacheControl(r, time.Hour); got != tt.want {
+			t.Errorf("cacheControl(%s, key %q) = %q, want %q", tt.url, tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// jobBatchSize is the number of rows a job processes between checkpoints.
+const jobBatchSize = 500
+
+// Job is a maintenance task that runs in the background, such as fixdb or resniff.
+// Jobs are stored in the database and checkpointed after every batch, so a job that was
+// interrupted by a restart resumes where it left off.
+type Job struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	Dry        bool   `json:"dry"`
+	Done       int64  `json:"done"`
+	Total      int64  `json:"total"`
+	Checkpoint string `json:"checkpoint"`
+	Error      string `json:"error"`
+	Started    int64  `json:"started"`
+	Finished   int64  `json:"finished"`
+}
+
+// jobFuncs maps job names to the functions that run them.
+var jobFuncs = map[string]func(job *Job, dry bool) error{
+	"fixdb":   dbFixer,
+	"resniff": resniff,
+	"rehash":  rehash,
+	"gc":      collectGarbage,
+	"scrub":   scrubJob,
+	"migrate": migrateLayout,
+}
+
+// jobs holds the jobs that are currently running.
+var (
+	jobs   = make(map[string]*Job)
+	jobsMu sync.Mutex
+)
+
+// setTotal sets the number of items the job will process.
+func (j *Job) setTotal(n int64) {
+	atomic.StoreInt64(&j.Total, n)
+}
+
+// step marks one item as processed.
+func (j *Job) step() {
+	atomic.AddInt64(&j.Done, 1)
+}
+
+func (j *Job) checkpoint() string {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	return j.Checkpoint
+}
+
+func (j *Job) setCheckpoint(id string) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	j.Checkpoint = id
+}
+
+// snapshot returns a copy of the job that is safe to encode while the job is running.
+func (j *Job) snapshot() Job {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	return Job{
+		ID:         j.ID,
+		Name:       j.Name,
+		Status:     j.Status,
+		Dry:        j.Dry,
+		Done:       atomic.LoadInt64(&j.Done),
+		Total:      atomic.LoadInt64(&j.Total),
+		Checkpoint: j.Checkpoint,
+		Error:      j.Error,
+		Started:    j.Started,
+		Finished:   j.Finished,
+	}
+}
+
+// saveJob writes the current state of the job to the database.
+func saveJob(j *Job) {
+	s := j.snapshot()
+	_, err := db.Exec("UPDATE jobs SET status = ?, done = ?, total = ?, checkpoint = ?, error = ?, finished = ? WHERE id = ?",
+		s.Status, s.Done, s.Total, s.Checkpoint, s.Error, s.Finished, s.ID)
+	if err != nil {
+		logger.Printf("Failed to save job %s: %v", s.ID, err)
+	}
+}
+
+// startJob runs the named job in the background. Only one job with the same name may run at a time.
+func startJob(name string, dry bool) (*Job, error) {
+	if _, ok := jobFuncs[name]; !ok {
+		return nil, fmt.Errorf("unknown job %q", name)
+	}
+
+	job := &Job{
+		ID:      randomHex(8),
+		Name:    name,
+		Status:  "running",
+		Dry:     dry,
+		Started: time.Now().Unix(),
+	}
+
+	_, err := db.Exec("INSERT INTO jobs (id, name, status, dry, done, total, checkpoint, error, started, finished) VALUES (?, ?, ?, ?, 0, 0, '', '', ?, 0)",
+		job.ID, job.Name, job.Status, job.Dry, job.Started)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := runJob(job); err != nil {
+		db.Exec("DELETE FROM jobs WHERE id = ?", job.ID)
+		return nil, err
+	}
+	return job, nil
+}
+
+// runJob starts a goroutine running the job, continuing from its checkpoint.
+func runJob(job *Job) error {
+	fn := jobFuncs[job.Name]
+
+	jobsMu.Lock()
+	for _, j := range jobs {
+		if j.Name == job.Name {
+			jobsMu.Unlock()
+			return fmt.Errorf("job %q is already running", job.Name)
+		}
+	}
+	jobs[job.ID] = job
+	jobsMu.Unlock()
+
+	go func() {
+		logLevelln(0, "Starting job "+job.Name+" ("+job.ID+")")
+		err := fn(job, job.Dry)
+
+		jobsMu.Lock()
+		job.Finished = time.Now().Unix()
+		if err != nil {
+			job.Status = "failed"
+			job.Error = err.Error()
+		} else {
+			job.Status = "done"
+		}
+		delete(jobs, job.ID)
+		jobsMu.Unlock()
+
+		saveJob(job)
+		if err != nil {
+			logger.Printf("Job %s (%s) failed: %v", job.Name, job.ID, err)
+			return
+		}
+		logLevelln(0, "Finished job "+job.Name+" ("+job.ID+")")
+	}()
+
+	return nil
+}
+
+// resumeJobs restarts jobs that were still running when the server stopped.
+func resumeJobs() {
+	list, err := loadJobs("status = 'running'")
+	if err != nil {
+		logger.Println("Failed to load jobs:", err)
+		return
+	}
+
+	for i := range list {
+		job := list[i]
+		if _, ok := jobFuncs[job.Name]; !ok {
+			continue
+		}
+		logLevelln(0, "Resuming job "+job.Name+" ("+job.ID+") after "+job.Checkpoint)
+		if err := runJob(&job); err != nil {
+			logger.Printf("Failed to resume job %s: %v", job.ID, err)
+		}
+	}
+}
+
+// loadJobs reads jobs from the database, newest first.
+func loadJobs(cond string, args ...interface{}) ([]Job, error) {
+	query := "SELECT id, name, status, dry, done, total, checkpoint, error, started, finished FROM jobs"
+	if cond != "" {
+		query += " WHERE " + cond
+	}
+	rows, err := db.Query(query+" ORDER BY started DESC LIMIT 100", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Job{}
+	for rows.Next() {
+		var j Job
+		var jobErr sql.NullString
+		if err := rows.Scan(&j.ID, &j.Name, &j.Status, &j.Dry, &j.Done, &j.Total, &j.Checkpoint, &jobErr, &j.Started, &j.Finished); err != nil {
+			return nil, err
+		}
+		j.Error = jobErr.String
+		list = append(list, j)
+	}
+	return list, rows.Err()
+}
+
+// forEachID calls fn for every id in the table matching cond, in id order, spread over -jobs:workers workers.
+// The job is checkpointed after every batch, and continues after its checkpoint when resumed.
+func forEachID(job *Job, table, cond string, fn func(id string)) error {
+	where := "id > ?"
+	if cond != "" {
+		where += " AND (" + cond + ")"
+	}
+
+	if atomic.LoadInt64(&job.Total) == 0 {
+		var remaining int64
+		err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", table, where), job.checkpoint()).Scan(&remaining)
+		if err != nil {
+			return fmt.Errorf("failed to get total row count: %v", err)
+		}
+		job.setTotal(atomic.LoadInt64(&job.Done) + remaining)
+		saveJob(job)
+	}
+
+	workers := *jobWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	for {
+		rows, err := db.Query(fmt.Sprintf("SELECT id FROM %s WHERE %s ORDER BY id LIMIT ?", table, where), job.checkpoint(), jobBatchSize)
+		if err != nil {
+			return fmt.Errorf("failed to query database: %v", err)
+		}
+		var ids []string
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan row: %v", err)
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error iterating over rows: %v", err)
+		}
+
+		if len(ids) == 0 {
+			return nil
+		}
+
+		queue := make(chan string)
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for id := range queue {
+					fn(id)
+					job.step()
+				}
+			}()
+		}
+		for _, id := range ids {
+			queue <- id
+		}
+		close(queue)
+		wg.Wait()
+
+		job.setCheckpoint(ids[len(ids)-1])
+		saveJob(job)
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+const base62 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// randomBase62 returns n random base62 characters.
+func randomBase62(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	for i := range b {
+		// 62 does not divide 256, the small bias does not matter for ids
+		b[i] = base62[int(b[i])%len(base62)]
+	}
+	return string(b)
+}
+
+// handleAdminJobs starts jobs and reports their status. Running jobs report their live progress,
+// other jobs are read from the database.
+func handleAdminJobs(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w, r, adminCors)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		id := r.URL.Query().Get("id")
+
+		var list []Job
+		var err error
+		if id != "" {
+			list, err = loadJobs("id = ?", id)
+		} else {
+			list, err = loadJobs("")
+		}
+		if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			return
+		}
+
+		jobsMu.Lock()
+		running := make(map[string]*Job, len(jobs))
+		for jobID, j := range jobs {
+			running[jobID] = j
+		}
+		jobsMu.Unlock()
+
+		for i := range list {
+			if j, ok := running[list[i].ID]; ok {
+				list[i] = j.snapshot()
+			}
+		}
+
+		if id != "" {
+			if len(list) == 0 {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(list[0])
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case http.MethodPost:
+		var request struct {
+			Name string `json:"name"`
+			Dry  bool   `json:"dry"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if _, ok := jobFuncs[request.Name]; !ok {
+			http.Error(w, "Unknown job", http.StatusBadRequest)
+			return
+		}
+
+		job, err := startJob(request.Name, request.Dry)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job.snapshot())
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// rehash fills in the size of every file and the perceptual hashes of images that are missing them,
+// for example because they were uploaded before those columns existed.
+func rehash(job *Job, dry bool) error {
+	cond := "size IS NULL OR ((ahash IS NULL OR ahash = '') AND type IN ('image/jpeg', 'image/png', 'image/gif'))"
+
+	return forEachID(job, "data", cond, func(id string) {
+		var contentType, ahash sql.NullString
+		err := db.QueryRow("SELECT type, ahash FROM data WHERE id = ?", id).Scan(&contentType, &ahash)
+		if err != nil {
+			logger.Printf("Failed to query %s: %v", id, err)
+			return
+		}
+
+		path, err := resolveBlob(id)
+		if err != nil {
+			logger.Printf("Failed to find file %s: %v", id, err)
+			return
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			logger.Printf("Failed to read file %s: %v", id, err)
+			return
+		}
+
+		var aHash, dHash string
+		if ahash.String == "" && isHashableImage(contentType.String) {
+			aHash, dHash, err = perceptualHashes(bytes.NewReader(data))
+			if err != nil {
+				logger.Printf("Failed to compute perceptual hashes for %s: %v", id, err)
+			}
+		}
+
+		if dry {
+			return
+		}
+
+		if aHash != "" {
+			_, err = db.Exec("UPDATE data SET size = ?, ahash = ?, dhash = ? WHERE id = ?", len(data), aHash, dHash, id)
+		} else {
+			_, err = db.Exec("UPDATE data SET size = ? WHERE id = ?", len(data), id)
+		}
+		if err != nil {
+			logger.Printf("Failed to update %s: %v", id, err)
+		}
+	})
+}
+
+// collectGarbage deletes quarantined files that have been quarantined for longer than -gc:quarantine.
+func collectGarbage(job *Job, dry bool) error {
+	cutoff := time.Now().Add(-*gcQuarantine).Unix()
+
+	return forEachID(job, "quarantine", fmt.Sprintf("quarantined < %d", cutoff), func(id string) {
+		if !dry {
+			if err := deleteUpload(id); err != nil {
+				logger.Printf("Failed to delete %s: %v", id, err)
+				return
+			}
+		}
+		logLevelln(0, "Deleted quarantined file "+id)
+	})
+}
@@ -0,0 +1,22 @@
+package hash
+
+import (
+	"errors"
+	"math/bits"
+)
+
+// Distance returns the Hamming distance between two hashes generated by
+// Ahash or Dhash, which is the number of bits that differ between them.
+// Both hashes must have the same length.
+func Distance(a, b []byte) (int, error) {
+	if len(a) != len(b) {
+		return 0, errors.New("hashes must be of equal length")
+	}
+
+	dist := 0
+	for i := range a {
+		dist += bits.OnesCount8(a[i] ^ b[i])
+	}
+
+	return dist, nil
+}
@@ -0,0 +1,371 @@
+// Package highlight is a small syntax highlighter. It splits source code into comments, strings,
+// numbers and keywords and returns HTML with a span for every token, one string per line.
+// It does not parse the code, so it is only as good as the rules of each language.
+package highlight
+
+import (
+	"html"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Language describes how to find the tokens of a language.
+type Language struct {
+	Name          string
+	Aliases       []string
+	Keywords      []string
+	LineComments  []string
+	BlockComments [][2]string
+	Quotes        []string
+	// RawQuotes are strings without escapes, like Go backticks.
+	RawQuotes []string
+	// LinePrefixes colors whole lines starting with a prefix, like + and - in diffs.
+	LinePrefixes map[string]string
+}
+
+// Token classes, used as CSS class names.
+const (
+	Comment = "c"
+	String  = "s"
+	Number  = "n"
+	Keyword = "k"
+	Added   = "ga"
+	Deleted = "gd"
+	Heading = "gh"
+)
+
+var languages = map[string]*Language{}
+
+func register(l *Language) {
+	languages[l.Name] = l
+	for _, alias := range l.Aliases {
+		languages[alias] = l
+	}
+}
+
+var cLike = []string{"//"}
+var cBlock = [][2]string{{"/*", "*/"}}
+
+func init() {
+	register(&Language{
+		Name:          "go",
+		Aliases:       []string{"golang"},
+		Keywords:      words("break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var nil true false iota"),
+		LineComments:  cLike,
+		BlockComments: cBlock,
+		Quotes:        []string{`"`, `'`},
+		RawQuotes:     []string{"`"},
+	})
+	register(&Language{
+		Name:          "javascript",
+		Aliases:       []string{"js", "typescript", "ts", "jsx", "tsx"},
+		Keywords:      words("async await break case catch class const continue debugger default delete do else export extends finally for from function if import in instanceof interface let new null of return static super switch this throw true false try type typeof undefined var void while with yield"),
+		LineComments:  cLike,
+		BlockComments: cBlock,
+		Quotes:        []string{`"`, `'`, "`"},
+	})
+	register(&Language{
+		Name:         "python",
+		Aliases:      []string{"py"},
+		Keywords:     words("and as assert async await break class continue def del elif else except False finally for from global if import in is lambda None nonlocal not or pass raise return True try while with yield self"),
+		LineComments: []string{"#"},
+		Quotes:       []string{`"""`, `'''`, `"`, `'`},
+	})
+	register(&Language{
+		Name:          "c",
+		Aliases:       []string{"h", "cpp", "c++", "cc", "hpp", "cs", "csharp", "java", "kotlin", "kt", "swift"},
+		Keywords:      words("auto bool break case catch char class const continue default delete do double else enum extern false final float for fun goto if implements import int interface long namespace new null nullptr package private protected public return short signed sizeof static struct super switch template this throw true try typedef union unsigned using val var virtual void volatile while"),
+		LineComments:  cLike,
+		BlockComments: cBlock,
+		Quotes:        []string{`"`, `'`},
+	})
+	register(&Language{
+		Name:          "rust",
+		Aliases:       []string{"rs"},
+		Keywords:      words("as async await break const continue crate dyn else enum extern false fn for if impl in let loop match mod move mut pub ref return self Self static struct super trait true type unsafe use where while"),
+		LineComments:  cLike,
+		BlockComments: cBlock,
+		Quotes:        []string{`"`},
+	})
+	register(&Language{
+		Name:         "shell",
+		Aliases:      []string{"sh", "bash", "zsh", "console"},
+		Keywords:     words("if then else elif fi for while until do done case esac in function return local export readonly echo exit set unset source"),
+		LineComments: []string{"#"},
+		Quotes:       []string{`"`},
+		RawQuotes:    []string{`'`},
+	})
+	register(&Language{
+		Name:     "json",
+		Keywords: words("true false null"),
+		Quotes:   []string{`"`},
+	})
+	register(&Language{
+		Name:         "yaml",
+		Aliases:      []string{"yml", "toml", "ini"},
+		Keywords:     words("true false null yes no on off"),
+		LineComments: []string{"#"},
+		Quotes:       []string{`"`, `'`},
+	})
+	register(&Language{
+		Name:          "sql",
+		Keywords:      words("select from where and or not insert into values update set delete create table index drop alter add column primary key foreign references join left right inner outer on group by order having limit offset as distinct null is in like between exists union all case when then else end count sum min max"),
+		LineComments:  []string{"--"},
+		BlockComments: cBlock,
+		Quotes:        []string{`'`, `"`},
+	})
+	register(&Language{
+		Name:          "html",
+		Aliases:       []string{"xml", "svg"},
+		BlockComments: [][2]string{{"<!--", "-->"}},
+		Quotes:        []string{`"`, `'`},
+	})
+	register(&Language{
+		Name:          "css",
+		Aliases:       []string{"scss"},
+		BlockComments: cBlock,
+		Quotes:        []string{`"`, `'`},
+	})
+	register(&Language{
+		Name:         "diff",
+		Aliases:      []string{"patch"},
+		LinePrefixes: map[string]string{"+++": Heading, "---": Heading, "@@": Heading, "+": Added, "-": Deleted},
+	})
+}
+
+func words(s string) []string {
+	return strings.Fields(s)
+}
+
+// Lookup returns a language by its name or alias.
+func Lookup(name string) (*Language, bool) {
+	l, ok := languages[strings.ToLower(name)]
+	return l, ok
+}
+
+// Names returns the names of all languages, without aliases.
+func Names() []string {
+	var names []string
+	for name, l := range languages {
+		if name == l.Name {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Highlight returns the lines of src as HTML. Unknown languages are only escaped.
+func Highlight(src, lang string) []string {
+	l, ok := Lookup(lang)
+	if !ok {
+		l = &Language{}
+	}
+
+	if l.LinePrefixes != nil {
+		return highlightLines(src, l)
+	}
+	return splitLines(tokenize(src, l))
+}
+
+type token struct {
+	class string
+	text  string
+}
+
+// tokenize splits src into tokens. Text that is not part of any token gets an empty class.
+func tokenize(src string, l *Language) []token {
+	keywords := map[string]bool{}
+	for _, k := range l.Keywords {
+		keywords[k] = true
+	}
+	caseInsensitive := l.Name == "sql"
+
+	var tokens []token
+	plain := strings.Builder{}
+	emit := func(class, text string) {
+		if plain.Len() > 0 {
+			tokens = append(tokens, token{"", plain.String()})
+			plain.Reset()
+		}
+		tokens = append(tokens, token{class, text})
+	}
+
+	i := 0
+	prevIdent := false
+outer:
+	for i < len(src) {
+		rest := src[i:]
+
+		for _, prefix := range l.LineComments {
+			if strings.HasPrefix(rest, prefix) {
+				end := strings.IndexByte(rest, '\n')
+				if end < 0 {
+					end = len(rest)
+				}
+				emit(Comment, rest[:end])
+				i += end
+				prevIdent = false
+				continue outer
+			}
+		}
+
+		for _, block := range l.BlockComments {
+			if strings.HasPrefix(rest, block[0]) {
+				end := strings.Index(rest[len(block[0]):], block[1])
+				if end < 0 {
+					end = len(rest)
+				} else {
+					end += len(block[0]) + len(block[1])
+				}
+				emit(Comment, rest[:end])
+				i += end
+				prevIdent = false
+				continue outer
+			}
+		}
+
+		for _, quote := range l.RawQuotes {
+			if strings.HasPrefix(rest, quote) {
+				end := strings.Index(rest[len(quote):], quote)
+				if end < 0 {
+					end = len(rest)
+				} else {
+					end += 2 * len(quote)
+				}
+				emit(String, rest[:end])
+				i += end
+				prevIdent = false
+				continue outer
+			}
+		}
+
+		for _, quote := range l.Quotes {
+			if strings.HasPrefix(rest, quote) {
+				end := stringEnd(rest, quote)
+				emit(String, rest[:end])
+				i += end
+				prevIdent = false
+				continue outer
+			}
+		}
+
+		r, size := utf8.DecodeRuneInString(rest)
+		switch {
+		case isIdentStart(r):
+			end := size
+			for end < len(rest) {
+				r, size := utf8.DecodeRuneInString(rest[end:])
+				if !isIdentStart(r) && !unicode.IsDigit(r) {
+					break
+				}
+				end += size
+			}
+			word := rest[:end]
+			if keywords[word] || (caseInsensitive && keywords[strings.ToLower(word)]) {
+				emit(Keyword, word)
+			} else {
+				plain.WriteString(word)
+			}
+			i += end
+			prevIdent = true
+			continue
+		case unicode.IsDigit(r) && !prevIdent:
+			end := 0
+			for end < len(rest) && (isNumberByte(rest[end])) {
+				end++
+			}
+			emit(Number, rest[:end])
+			i += end
+			continue
+		}
+
+		plain.WriteString(rest[:size])
+		i += size
+		prevIdent = false
+	}
+
+	if plain.Len() > 0 {
+		tokens = append(tokens, token{"", plain.String()})
+	}
+	return tokens
+}
+
+// stringEnd returns the end of a string starting at the beginning of s. Single line strings end at
+// the end of the line if they are not closed.
+func stringEnd(s, quote string) int {
+	multiline := len(quote) == 3 || quote == "`"
+	i := len(quote)
+	for i < len(s) {
+		switch {
+		case s[i] == '\\':
+			i += 2
+			continue
+		case strings.HasPrefix(s[i:], quote):
+			return i + len(quote)
+		case s[i] == '\n' && !multiline:
+			return i
+		}
+		i++
+	}
+	return len(s)
+}
+
+func isIdentStart(r rune) bool {
+	return r == '_' || r == '$' || unicode.IsLetter(r)
+}
+
+func isNumberByte(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'f') || (b >= 'A' && b <= 'F') || b == '.' || b == 'x' || b == 'X' || b == '_'
+}
+
+// splitLines turns tokens into HTML lines. Tokens spanning several lines, like block comments,
+// are closed at the end of each line and opened again on the next one.
+func splitLines(tokens []token) []string {
+	var lines []string
+	var line strings.Builder
+	for _, t := range tokens {
+		parts := strings.Split(t.text, "\n")
+		for n, part := range parts {
+			if n > 0 {
+				lines = append(lines, line.String())
+				line.Reset()
+			}
+			if part == "" {
+				continue
+			}
+			if t.class == "" {
+				line.WriteString(html.EscapeString(part))
+			} else {
+				line.WriteString(`<span class="` + t.class + `">` + html.EscapeString(part) + `</span>`)
+			}
+		}
+	}
+	lines = append(lines, line.String())
+	return lines
+}
+
+// highlightLines colors whole lines by their prefix.
+func highlightLines(src string, l *Language) []string {
+	// Longer prefixes first, so +++ wins over +
+	prefixes := make([]string, 0, len(l.LinePrefixes))
+	for prefix := range l.LinePrefixes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+
+	lines := strings.Split(src, "\n")
+	out := make([]string, len(lines))
+	for n, line := range lines {
+		out[n] = html.EscapeString(line)
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(line, prefix) {
+				out[n] = `<span class="` + l.LinePrefixes[prefix] + `">` + out[n] + `</span>`
+				break
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,91 @@
+package highlight
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestHighlight(t *testing.T) {
+	tests := []struct {
+		lang string
+		src  string
+		want []string
+	}{
+		{"go", `x := "a" // b`, []string{`x := <span class="s">&#34;a&#34;</span> <span class="c">// b</span>`}},
+		{"go", "func f() int { return 0x1F }", []string{`<span class="k">func</span> f() int { <span class="k">return</span> <span class="n">0x1F</span> }`}},
+		{"go", "a1 := `raw\\n`", []string{`a1 := <span class="s">` + "`raw\\n`" + `</span>`}},
+		{"go", "/* one\ntwo */", []string{`<span class="c">/* one</span>`, `<span class="c">two */</span>`}},
+		{"python", `s = 'it\'s'`, []string{`s = <span class="s">&#39;it\&#39;s&#39;</span>`}},
+		{"sql", "SELECT 1", []string{`<span class="k">SELECT</span> <span class="n">1</span>`}},
+		{"diff", "+++ b\n+added\n-removed", []string{`<span class="gh">+++ b</span>`, `<span class="ga">+added</span>`, `<span class="gd">-removed</span>`}},
+		{"unknown", "if x", []string{"if x"}},
+	}
+	for _, tt := range tests {
+		got := Highlight(tt.src, tt.lang)
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("Highlight(%q, %s) =\n%q\nwant\n%q", tt.src, tt.lang, got, tt.want)
+		}
+	}
+}
+
+func TestHighlightEscapes(t *testing.T) {
+	tests := []struct {
+		lang string
+		src  string
+		want []string
+	}{
+		{"unknown", `<script>alert("x" & 'y')</script>`, []string{`&lt;script&gt;alert(&#34;x&#34; &amp; &#39;y&#39;)&lt;/script&gt;`}},
+		{"go", `"</span><script>"`, []string{`<span class="s">&#34;&lt;/span&gt;&lt;script&gt;&#34;</span>`}},
+		{"go", `// <b> & "c"`, []string{`<span class="c">// &lt;b&gt; &amp; &#34;c&#34;</span>`}},
+		{"html", `<a href="x">&amp;</a>`, []string{`&lt;a href=<span class="s">&#34;x&#34;</span>&gt;&amp;amp;&lt;/a&gt;`}},
+		{"html", "<!-- <b>\n& -->", []string{`<span class="c">&lt;!-- &lt;b&gt;</span>`, `<span class="c">&amp; --&gt;</span>`}},
+		{"diff", `+<img src="x" onerror='y'>`, []string{`<span class="ga">+&lt;img src=&#34;x&#34; onerror=&#39;y&#39;&gt;</span>`}},
+	}
+	for _, tt := range tests {
+		got := Highlight(tt.src, tt.lang)
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("Highlight(%q, %s) =\n%q\nwant\n%q", tt.src, tt.lang, got, tt.want)
+		}
+	}
+}
+
+// spanTags matches the tags Highlight adds, the only markup allowed in its output.
+var spanTags = regexp.MustCompile(`<span class="[a-z]+">|</span>`)
+
+func TestHighlightRoundTrip(t *testing.T) {
+	// Whatever the language, removing the spans and unescaping gives back the source, and no
+	// other markup is left
+	src := "package main\n/* <x> & \"y\" */\nvar s = \"a<b>\\\"&'\" + `c'd\"` // </span>\nx := 'q' & 1.5e3\n<!-- -->\n+\"+\"\n-'-'\n\"unclosed <i>\n"
+	for _, lang := range append(Names(), "unknown") {
+		lines := Highlight(src, lang)
+		for n, line := range lines {
+			bare := spanTags.ReplaceAllString(line, "")
+			if strings.ContainsAny(bare, `<>"'`) {
+				t.Errorf("%s: line %d has unescaped markup: %s", lang, n, line)
+			}
+			lines[n] = html.UnescapeString(bare)
+		}
+		if got := strings.Join(lines, "\n"); got != src {
+			t.Errorf("%s: highlighted source does not unescape to the original:\n%q", lang, got)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	for alias, name := range map[string]string{"golang": "go", "TS": "javascript", "py": "python", "yml": "yaml", "patch": "diff"} {
+		l, ok := Lookup(alias)
+		if !ok || l.Name != name {
+			t.Errorf("Lookup(%q) = %v, want %s", alias, l, name)
+		}
+	}
+	if _, ok := Lookup("brainfuck"); ok {
+		t.Error("Lookup found an unknown language")
+	}
+	for _, name := range Names() {
+		if l, _ := Lookup(name); l.Name != name {
+			t.Errorf("Names returned the alias %q", name)
+		}
+	}
+}
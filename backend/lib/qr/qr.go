@@ -0,0 +1,551 @@
+// Package qr encodes data as QR codes (ISO/IEC 18004) and renders them as PNG or SVG images.
+// Data is always encoded in byte mode, which is enough for URLs.
+package qr
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"strings"
+)
+
+// Level is the error correction level of a QR code. Higher levels survive more damage but need a
+// larger code for the same data.
+type Level int
+
+const (
+	L Level = iota // recovers about 7% of the code
+	M              // recovers about 15% of the code
+	Q              // recovers about 25% of the code
+	H              // recovers about 30% of the code
+)
+
+var ErrTooLong = errors.New("data is too long for a QR code")
+
+// ParseLevel parses an error correction level like "M".
+func ParseLevel(s string) (Level, bool) {
+	switch strings.ToUpper(s) {
+	case "L":
+		return L, true
+	case "M":
+		return M, true
+	case "Q":
+		return Q, true
+	case "H":
+		return H, true
+	}
+	return 0, false
+}
+
+// formatBits are the bits of a level in the format information, which are not in the order of the levels.
+func (l Level) formatBits() int {
+	return [...]int{1, 0, 3, 2}[l]
+}
+
+// eccPerBlock and blocks are the number of error correction codewords per block and the number of
+// blocks, by level and version. Index 0 is unused.
+var eccPerBlock = [4][41]int{
+	{0, 7, 10, 15, 20, 26, 18, 20, 24, 30, 18, 20, 24, 26, 30, 22, 24, 28, 30, 28, 28, 28, 28, 30, 30, 26, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{0, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28},
+	{0, 13, 22, 18, 26, 18, 24, 18, 22, 20, 24, 28, 26, 24, 20, 30, 24, 28, 28, 26, 30, 28, 30, 30, 30, 30, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{0, 17, 28, 22, 16, 22, 28, 26, 26, 24, 28, 24, 28, 22, 24, 24, 30, 28, 28, 26, 28, 30, 24, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+}
+
+var blocks = [4][41]int{
+	{0, 1, 1, 1, 1, 1, 2, 2, 2, 2, 4, 4, 4, 4, 4, 6, 6, 6, 6, 7, 8, 8, 9, 9, 10, 12, 12, 12, 13, 14, 15, 16, 17, 18, 19, 19, 20, 21, 22, 24, 25},
+	{0, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49},
+	{0, 1, 1, 2, 2, 4, 4, 6, 6, 8, 8, 8, 10, 12, 16, 12, 17, 16, 18, 21, 20, 23, 23, 25, 27, 29, 34, 34, 35, 38, 40, 43, 45, 48, 51, 53, 56, 59, 62, 65, 68},
+	{0, 1, 1, 2, 4, 4, 4, 5, 6, 8, 8, 11, 11, 16, 16, 18, 16, 19, 21, 25, 25, 25, 34, 30, 32, 35, 37, 40, 42, 45, 48, 51, 54, 57, 60, 63, 66, 70, 74, 77, 81},
+}
+
+// Code is an encoded QR code.
+type Code struct {
+	// Size is the width and height of the code in modules, without the quiet zone
+	Size    int
+	Version int
+	Level   Level
+
+	modules  []bool
+	function []bool
+}
+
+// Black reports whether the module at column x and row y is dark.
+func (c *Code) Black(x, y int) bool {
+	if x < 0 || y < 0 || x >= c.Size || y >= c.Size {
+		return false
+	}
+	return c.modules[y*c.Size+x]
+}
+
+// Encode encodes data in the smallest QR code that fits it at the error correction level.
+func Encode(data []byte, level Level) (*Code, error) {
+	if level < L || level > H {
+		return nil, fmt.Errorf("invalid error correction level %d", level)
+	}
+
+	version := 0
+	for v := 1; v <= 40; v++ {
+		if 4+countBits(v)+8*len(data) <= 8*dataCodewords(v, level) {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, ErrTooLong
+	}
+
+	// Mode indicator, character count and data, then the terminator and padding
+	var b bitBuffer
+	b.append(0x4, 4)
+	b.append(len(data), countBits(version))
+	for _, d := range data {
+		b.append(int(d), 8)
+	}
+	capacity := 8 * dataCodewords(version, level)
+	b.append(0, min(4, capacity-b.len()))
+	b.append(0, (8-b.len()%8)%8)
+	for pad := 0xEC; b.len() < capacity; pad ^= 0xEC ^ 0x11 {
+		b.append(pad, 8)
+	}
+
+	c := &Code{Size: version*4 + 17, Version: version, Level: level}
+	c.modules = make([]bool, c.Size*c.Size)
+	c.function = make([]bool, c.Size*c.Size)
+	c.drawFunctionPatterns()
+	c.drawCodewords(addECC(b.bytes(), version, level))
+
+	// Use the mask that gives the fewest patterns that are hard to scan
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		c.applyMask(mask)
+		c.drawFormat(mask)
+		if p := c.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		c.applyMask(mask)
+	}
+	c.applyMask(best)
+	c.drawFormat(best)
+	return c, nil
+}
+
+// countBits is the length of the character count in byte mode.
+func countBits(version int) int {
+	if version < 10 {
+		return 8
+	}
+	return 16
+}
+
+// rawModules is the number of modules of a version that can hold data and error correction, which
+// are all modules except the function patterns and the format and version information.
+func rawModules(version int) int {
+	n := (16*version+128)*version + 64
+	if version >= 2 {
+		align := version/7 + 2
+		n -= (25*align-10)*align - 55
+		if version >= 7 {
+			n -= 36
+		}
+	}
+	return n
+}
+
+func dataCodewords(version int, level Level) int {
+	return rawModules(version)/8 - eccPerBlock[level][version]*blocks[level][version]
+}
+
+// alignmentPositions returns the rows and columns of the centers of the alignment patterns.
+func alignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	count := version/7 + 2
+	step := (version*8 + count*3 + 5) / (count*4 - 4) * 2
+	positions := make([]int, count)
+	positions[0] = 6
+	for i, pos := count-1, version*4+10; i > 0; i, pos = i-1, pos-step {
+		positions[i] = pos
+	}
+	return positions
+}
+
+// addECC splits the data into blocks, adds the Reed-Solomon error correction codewords to every
+// block and interleaves them.
+func addECC(data []byte, version int, level Level) []byte {
+	numBlocks := blocks[level][version]
+	ecc := eccPerBlock[level][version]
+	raw := rawModules(version) / 8
+	numShort := numBlocks - raw%numBlocks
+	shortLen := raw / numBlocks
+
+	divisor := rsDivisor(ecc)
+	var dataBlocks, eccBlocks [][]byte
+	for i, k := 0, 0; i < numBlocks; i++ {
+		n := shortLen - ecc
+		if i >= numShort {
+			n++
+		}
+		block := data[k : k+n]
+		k += n
+		dataBlocks = append(dataBlocks, block)
+		eccBlocks = append(eccBlocks, rsRemainder(block, divisor))
+	}
+
+	result := make([]byte, 0, raw)
+	for i := 0; i <= shortLen-ecc; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < ecc; i++ {
+		for _, block := range eccBlocks {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+// gfMul multiplies in GF(2^8) with the QR code polynomial x^8 + x^4 + x^3 + x^2 + 1.
+func gfMul(x, y byte) byte {
+	var z byte
+	for i := 7; i >= 0; i-- {
+		carry := z >> 7
+		z = z<<1 ^ carry*0x1D
+		z ^= (y >> i & 1) * x
+	}
+	return z
+}
+
+// rsDivisor returns the generator polynomial of the given degree, without its leading term.
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	var root byte = 1
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMul(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	return result
+}
+
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, d := range divisor {
+			result[i] ^= gfMul(d, factor)
+		}
+	}
+	return result
+}
+
+func (c *Code) set(x, y int, black, function bool) {
+	c.modules[y*c.Size+x] = black
+	if function {
+		c.function[y*c.Size+x] = true
+	}
+}
+
+func (c *Code) isFunction(x, y int) bool {
+	return c.function[y*c.Size+x]
+}
+
+func (c *Code) drawFunctionPatterns() {
+	for i := 0; i < c.Size; i++ {
+		c.set(6, i, i%2 == 0, true)
+		c.set(i, 6, i%2 == 0, true)
+	}
+
+	c.drawFinder(3, 3)
+	c.drawFinder(c.Size-4, 3)
+	c.drawFinder(3, c.Size-4)
+
+	positions := alignmentPositions(c.Version)
+	last := len(positions) - 1
+	for i, x := range positions {
+		for j, y := range positions {
+			// Skip the ones that would overlap the finder patterns
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					c.set(x+dx, y+dy, max(abs(dx), abs(dy)) != 1, true)
+				}
+			}
+		}
+	}
+
+	// Reserve the format information, the real bits are drawn with the mask
+	c.drawFormat(0)
+	c.drawVersion()
+}
+
+// drawFinder draws a finder pattern with its separator around the center x, y.
+func (c *Code) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || yy < 0 || xx >= c.Size || yy >= c.Size {
+				continue
+			}
+			d := max(abs(dx), abs(dy))
+			c.set(xx, yy, d != 2 && d != 4, true)
+		}
+	}
+}
+
+func (c *Code) drawFormat(mask int) {
+	data := c.Level.formatBits()<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+
+	// Around the top left finder pattern
+	for i := 0; i <= 5; i++ {
+		c.set(8, i, bit(i), true)
+	}
+	c.set(8, 7, bit(6), true)
+	c.set(8, 8, bit(7), true)
+	c.set(7, 8, bit(8), true)
+	for i := 9; i < 15; i++ {
+		c.set(14-i, 8, bit(i), true)
+	}
+
+	// Split between the other two finder patterns
+	for i := 0; i < 8; i++ {
+		c.set(c.Size-1-i, 8, bit(i), true)
+	}
+	for i := 8; i < 15; i++ {
+		c.set(8, c.Size-15+i, bit(i), true)
+	}
+	c.set(8, c.Size-8, true, true)
+}
+
+func (c *Code) drawVersion() {
+	if c.Version < 7 {
+		return
+	}
+	rem := c.Version
+	for i := 0; i < 12; i++ {
+		rem = rem<<1 ^ (rem>>11)*0x1F25
+	}
+	bits := c.Version<<12 | rem
+
+	for i := 0; i < 18; i++ {
+		black := bits>>i&1 == 1
+		a, b := c.Size-11+i%3, i/3
+		c.set(a, b, black, true)
+		c.set(b, a, black, true)
+	}
+}
+
+// drawCodewords places the codewords in the zigzag order, two columns at a time from the right,
+// skipping the function patterns.
+func (c *Code) drawCodewords(data []byte) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < c.Size; vert++ {
+			y := vert
+			if upward {
+				y = c.Size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if c.isFunction(x, y) || i >= len(data)*8 {
+					continue
+				}
+				c.modules[y*c.Size+x] = data[i>>3]>>(7-i&7)&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+// applyMask flips the data modules selected by a mask. Applying a mask twice undoes it.
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.isFunction(x, y) {
+				continue
+			}
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if flip {
+				c.modules[y*c.Size+x] = !c.modules[y*c.Size+x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard a code is to scan, using the rules of the specification.
+func (c *Code) penalty() int {
+	p := 0
+	get := func(x, y int, vertical bool) bool {
+		if vertical {
+			return c.Black(y, x)
+		}
+		return c.Black(x, y)
+	}
+
+	for _, vertical := range []bool{false, true} {
+		for y := 0; y < c.Size; y++ {
+			// Runs of five or more modules of the same color
+			run := 0
+			for x := 0; x < c.Size; x++ {
+				if x > 0 && get(x, y, vertical) == get(x-1, y, vertical) {
+					run++
+				} else {
+					run = 1
+				}
+				if run == 5 {
+					p += 3
+				} else if run > 5 {
+					p++
+				}
+			}
+
+			// Patterns that look like finder patterns, with four light modules on one side
+			for x := -4; x < c.Size; x++ {
+				pattern := true
+				for i, want := range [7]bool{true, false, true, true, true, false, true} {
+					if get(x+4+i, y, vertical) != want {
+						pattern = false
+						break
+					}
+				}
+				if !pattern {
+					continue
+				}
+				before, after := true, true
+				for i := 0; i < 4; i++ {
+					before = before && !get(x+i, y, vertical)
+					after = after && !get(x+11+i, y, vertical)
+				}
+				if before || after {
+					p += 40
+				}
+			}
+		}
+	}
+
+	// Blocks of 2x2 modules of the same color
+	dark := 0
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			b := c.Black(x, y)
+			if b {
+				dark++
+			}
+			if x+1 < c.Size && y+1 < c.Size && b == c.Black(x+1, y) && b == c.Black(x, y+1) && b == c.Black(x+1, y+1) {
+				p += 3
+			}
+		}
+	}
+
+	// Balance of dark and light modules, 10 points for every 5% away from half
+	total := c.Size * c.Size
+	p += abs(dark*20-total*10) / total * 10
+	return p
+}
+
+// Image renders the code with every module scale pixels wide and a quiet zone of margin modules.
+func (c *Code) Image(scale, margin int) image.Image {
+	size := (c.Size + 2*margin) * scale
+	img := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{color.White, color.Black})
+	for py := 0; py < size; py++ {
+		y := py/scale - margin
+		for px := 0; px < size; px++ {
+			if c.Black(px/scale-margin, y) {
+				img.Pix[py*img.Stride+px] = 1
+			}
+		}
+	}
+	return img
+}
+
+// WriteSVG writes the code as an SVG image size pixels wide, with a quiet zone of margin modules.
+// Every dark module is a square in a single path, so the image stays small.
+func (c *Code) WriteSVG(w io.Writer, size, margin int) error {
+	var path strings.Builder
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.Black(x, y) {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x+margin, y+margin)
+			}
+		}
+	}
+	view := c.Size + 2*margin
+	_, err := fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+		`<rect width="100%%" height="100%%" fill="#fff"/><path fill="#000" d="%s"/></svg>`+"\n",
+		size, size, view, view, path.String())
+	return err
+}
+
+type bitBuffer struct {
+	bits []bool
+}
+
+func (b *bitBuffer) append(value, n int) {
+	for i := n - 1; i >= 0; i-- {
+		b.bits = append(b.bits, value>>i&1 == 1)
+	}
+}
+
+func (b *bitBuffer) len() int {
+	return len(b.bits)
+}
+
+func (b *bitBuffer) bytes() []byte {
+	out := make([]byte, (len(b.bits)+7)/8)
+	for i, bit := range b.bits {
+		if bit {
+			out[i/8] |= 1 << (7 - i%8)
+		}
+	}
+	return out
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,267 @@
+package qr
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// matrix draws a code with # for dark and . for light modules, one row per line.
+func matrix(c *Code) string {
+	var b strings.Builder
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.Black(x, y) {
+				b.WriteByte('#')
+			} else {
+				b.WriteByte('.')
+			}
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// The expected codes were made with another encoder and checked to give the same matrix.
+
+func TestEncodeVersion1(t *testing.T) {
+	tests := []struct {
+		data  string
+		level Level
+		want  string
+	}{
+		{"y", L, `
+#######..#.##.#######
+#.....#.##.#..#.....#
+#.###.#.##..#.#.###.#
+#.###.#..#.#..#.###.#
+#.###.#.#...#.#.###.#
+#.....#.#..##.#.....#
+#######.#.#.#.#######
+........#####........
+##.#..##.##...###.##.
+###..#........#...##.
+.#.#..#.###.##.....##
+##.##..#..##.....##.#
+####..#.#.#.#.#.#.#..
+........#.##...###.##
+#######.#.#..#.#..##.
+#.....#..#####.###...
+#.###.#....#..#######
+#.###.#.##.#.....####
+#.###.#..##.#...#...#
+#.....#.##...##.#.#..
+#######.#..##...####.
+`},
+		{"y", M, `
+#######...##..#######
+#.....#.##..#.#.....#
+#.###.#...##..#.###.#
+#.###.#..#..#.#.###.#
+#.###.#.#.#.#.#.###.#
+#.....#..#..#.#.....#
+#######.#.#.#.#######
+.........####........
+#.#.#.#..#.#....#..#.
+#..#.#.##.....#...##.
+##.#..#.###.#...#...#
+###.#..####...#...#..
+.#.##.###.#.#.#.#.#..
+........##.#.#.#.#..#
+#######...##.###.####
+#.....#..#####.###...
+#.###.#.####.###.##.#
+#.###.#...#...#...##.
+#.###.#.#...#...#...#
+#.....#..##...#...##.
+#######.##..#.#.#.###
+`},
+		{"h", Q, `
+#######.##.#..#######
+#.....#.#...#.#.....#
+#.###.#.#####.#.###.#
+#.###.#.##..#.#.###.#
+#.###.#.#.##..#.###.#
+#.....#..#..#.#.....#
+#######.#.#.#.#######
+........#.##.........
+.##.#.##..#.#.#.#####
+#.###..##.#...#...##.
+##.#.####.#.#...#...#
+#.#..#..#.....#...##.
+##..###.#.....#.#.#..
+........#..#.#.#.#.##
+#######.##..####.####
+#.....#.....##.###...
+#.###.#.###..###.##.#
+#.###.#...#...#...##.
+#.###.#.#...#...#...#
+#.....#.#.....#...##.
+#######.....#.#.#.###
+`},
+		{"y", H, `
+#######....##.#######
+#.....#..###..#.....#
+#.###.#..#....#.###.#
+#.###.#..#.#..#.###.#
+#.###.#.##..#.#.###.#
+#.....#...###.#.....#
+#######.#.#.#.#######
+........##..#........
+..##..###..#.##.#....
+##..##..#.##.#...#...
+.##.#.#.####.....##.#
+.#..##.#.#..#..####..
+#.#...##..##.#.#..#.#
+........#.#.#....#.#.
+#######.###.#..#.#...
+#.....#..#.#.####.##.
+#.###.#..#...####...#
+#.###.#.#.##.#######.
+#.###.#.##..##.#.....
+#.....#.....#..#..#.#
+#######..#####..#....
+`},
+	}
+	for _, tt := range tests {
+		c, err := Encode([]byte(tt.data), tt.level)
+		if err != nil {
+			t.Fatalf("Encode(%q, %d) = %v", tt.data, tt.level, err)
+		}
+		if c.Version != 1 || c.Size != 21 {
+			t.Errorf("Encode(%q, %d) gave version %d size %d, want version 1 size 21", tt.data, tt.level, c.Version, c.Size)
+		}
+		if got := matrix(c); got != tt.want[1:] {
+			t.Errorf("Encode(%q, %d) =\n%s\nwant\n%s", tt.data, tt.level, got, tt.want[1:])
+		}
+	}
+}
+
+func TestEncodeKnownAnswers(t *testing.T) {
+	// Larger codes are compared by the sha256 of their matrix. The data is the start of base
+	// repeated to n bytes.
+	tests := []struct {
+		base    string
+		n       int
+		level   Level
+		version int
+		sha256  string
+	}{
+		{"Hello, World! ", 18, L, 2, "8b51cae69f06ed2d6d49a3b2d90e63b9546a442ad7e1e80e7a27605e2dc53d0b"},
+		{"yapc ", 135, L, 7, "86cc6cf1c81241e7ad309859deebd7ab4bc8856048c4f630c1ec7dd4ce7ed3ce"},
+		{"yapc ", 231, L, 10, "a3edfefbe7517c17f687968bb604200069afac1bc5919743db5013007de57d69"},
+		{"yapc ", 459, L, 15, "1a5a06fc6946e6de9459a22e508fb75e1e960f547e9a70904c3b43c356df687f"},
+		{"yapc ", 1368, L, 27, "60b951e024bba3c0116399c79621f11f7caf895db507fe9f2cb92ec50179c64b"},
+		{"yapc ", 2810, L, 40, "254d51a5a0f4cd20bbbcb70437f59c8fcc3c50a41e2c598f5f1944f322a178c3"},
+		{"yapc ", 15, M, 2, "3e1cc4be34cac64aff134f42d0f83d94ead7843164c235c421bb1a1053fb6d35"},
+		{"yapc ", 107, M, 7, "5b1983f0b00c95cc51b4caccfa4248586dcc2097882309b39a87fc2ca2ea8937"},
+		{"yapc ", 181, M, 10, "7de91303a757e3a0d3118de5452298db8b8fde5a79149b4ba8b79357044dab87"},
+		{"yapc ", 363, M, 15, "5efd247abbfa5f60c52f164c34bfcfc131b26f7ccbd9fa9f3e47632d31cab2fa"},
+		{"yapc ", 1060, M, 27, "2491ef05f5dd53466ae4a2d91c8dd8f63220e745555616525dd53d1c17753cf9"},
+		{"yapc ", 2214, M, 40, "f9f7ada2b0cc2a79451fdb7761486b0a7f67d74bcd6673b924050c691e12c805"},
+		{"yapc ", 12, Q, 2, "eec3cf7646d9aec8a3779a87804db10a8e9fdc096ff90d718dfb4fc43f77cc14"},
+		{"yapc ", 75, Q, 7, "29b5f4f5426e7d96364a533fa4db533a324aa4627329cb4d9b7b5d857d413aa3"},
+		{"Hello, World! ", 131, Q, 10, "782f3fbd7b4725cef31632880007a65d6488bd723409af3dd356f4466c679783"},
+		{"yapc ", 259, Q, 15, "d8c1609f5a37cdfd856c0ee3f166105141e891e32e12d691662e4fa46636ff66"},
+		{"yapc ", 752, Q, 27, "a07cc1e23cb65a3238702061d43bca3affcd658af8460fc9f9eae01e5426541b"},
+		{"yapc ", 1580, Q, 40, "936a47ad2e36466a58914286792202b70fb366b573d9db163fff2fd44e9f6b8c"},
+		{"yapc ", 8, H, 2, "fdcaed393b907f340bf8ca0a0e56d101925a44091271969805095599f56f613a"},
+		{"yapc ", 59, H, 7, "b48191adafb8c3d3690d2184fe30d2554685b6d60370ef755df4ed9f4a34d1c0"},
+		{"yapc ", 99, H, 10, "89f71e5632769a631eb39ed7e8dd1a6ecf47ca24943e6d81479bce203dccfb61"},
+		{"yapc ", 195, H, 15, "482556fa840e6baff87d66f8c1655a5f4f117e08b5a402d5f2b884c1ba4a3de3"},
+		{"yapc ", 594, H, 27, "c7483415a5a8f049a9a9c5a6378b23d04f6c8981497e8b94bf210e00a69d0366"},
+		{"https://example.com/?q=", 1220, H, 40, "94a773e0937bf24e49547c87a7859262ddf601151eebe425b256d3f8ab2a230f"},
+	}
+	for _, tt := range tests {
+		data := strings.Repeat(tt.base, tt.n/len(tt.base)+1)[:tt.n]
+		c, err := Encode([]byte(data), tt.level)
+		if err != nil {
+			t.Errorf("Encode(%d bytes, %d) = %v", tt.n, tt.level, err)
+			continue
+		}
+		if c.Version != tt.version || c.Size != tt.version*4+17 {
+			t.Errorf("Encode(%d bytes, %d) gave version %d size %d, want version %d", tt.n, tt.level, c.Version, c.Size, tt.version)
+			continue
+		}
+		sum := sha256.Sum256([]byte(matrix(c)))
+		if got := hex.EncodeToString(sum[:]); got != tt.sha256 {
+			t.Errorf("Encode(%d bytes, %d) matrix has sha256 %s, want %s", tt.n, tt.level, got, tt.sha256)
+		}
+	}
+}
+
+func TestEncodeCapacity(t *testing.T) {
+	// The most bytes that fit in versions 1 and 40 at each level
+	tests := []struct {
+		level Level
+		v1    int
+		v40   int
+	}{
+		{L, 17, 2953},
+		{M, 14, 2331},
+		{Q, 11, 1663},
+		{H, 7, 1273},
+	}
+	for _, tt := range tests {
+		for _, n := range []int{tt.v1, tt.v1 + 1, tt.v40} {
+			c, err := Encode(bytes.Repeat([]byte("a"), n), tt.level)
+			if err != nil {
+				t.Errorf("Encode(%d bytes, %d) = %v", n, tt.level, err)
+				continue
+			}
+			want := 40
+			if n == tt.v1 {
+				want = 1
+			} else if n == tt.v1+1 {
+				want = 2
+			}
+			if c.Version != want {
+				t.Errorf("Encode(%d bytes, %d) gave version %d, want %d", n, tt.level, c.Version, want)
+			}
+		}
+		if _, err := Encode(bytes.Repeat([]byte("a"), tt.v40+1), tt.level); !errors.Is(err, ErrTooLong) {
+			t.Errorf("Encode(%d bytes, %d) = %v, want %v", tt.v40+1, tt.level, err, ErrTooLong)
+		}
+	}
+	if _, err := Encode([]byte("a"), H+1); err == nil {
+		t.Error("Encode accepted an invalid level")
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for s, want := range map[string]Level{"L": L, "m": M, "Q": Q, "h": H} {
+		if got, ok := ParseLevel(s); !ok || got != want {
+			t.Errorf("ParseLevel(%q) = %d, %v, want %d", s, got, ok, want)
+		}
+	}
+	if _, ok := ParseLevel("X"); ok {
+		t.Error("ParseLevel accepted X")
+	}
+}
+
+func TestImage(t *testing.T) {
+	c, err := Encode([]byte("y"), L)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := c.Image(2, 4)
+	if size := img.Bounds().Dx(); size != (21+2*4)*2 {
+		t.Fatalf("image is %d pixels wide, want %d", size, (21+2*4)*2)
+	}
+	// Every module is scale pixels, after a quiet zone of margin modules
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			r, _, _, _ := img.At((x+4)*2+1, (y+4)*2+1).RGBA()
+			if (r == 0) != c.Black(x, y) {
+				t.Fatalf("pixel of module %d,%d does not match the code", x, y)
+			}
+		}
+	}
+	if err := png.Encode(&bytes.Buffer{}, img); err != nil {
+		t.Errorf("image does not encode as PNG: %v", err)
+	}
+}
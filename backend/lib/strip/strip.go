@@ -0,0 +1,211 @@
+// Package strip removes metadata like EXIF, XMP and ICC profiles from JPEG and PNG images
+// without decoding them, so the image data itself is left untouched.
+package strip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	jpegSignature = []byte{0xFF, 0xD8}
+	pngSignature  = []byte("\x89PNG\r\n\x1a\n")
+
+	ErrInvalid = errors.New("invalid or truncated image")
+)
+
+// Metadata removes metadata from a JPEG or PNG image. It returns the new image and whether
+// anything was removed. Other formats are returned unchanged.
+func Metadata(data []byte) ([]byte, bool, error) {
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		return PNG(data)
+	case bytes.HasPrefix(data, jpegSignature):
+		return JPEG(data)
+	}
+	return data, false, nil
+}
+
+// Supported reports whether data starts like a JPEG or PNG image, the formats Metadata strips.
+// Only the first 8 bytes are needed.
+func Supported(data []byte) bool {
+	return bytes.HasPrefix(data, pngSignature) || bytes.HasPrefix(data, jpegSignature)
+}
+
+// JPEG removes the EXIF and XMP (APP1), ICC profile (APP2), IPTC (APP13) and comment segments
+// of a JPEG image. The EXIF orientation is kept in a minimal EXIF segment, so photos are not shown
+// rotated after stripping.
+func JPEG(data []byte) ([]byte, bool, error) {
+	if !bytes.HasPrefix(data, jpegSignature) {
+		return data, false, ErrInvalid
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, jpegSignature...)
+	stripped := false
+	orientation := uint16(0)
+	wroteOrientation := false
+
+	i := 2
+	for {
+		if i+2 > len(data) || data[i] != 0xFF {
+			return data, false, ErrInvalid
+		}
+		marker := data[i+1]
+
+		// Padding before a marker
+		if marker == 0xFF {
+			i++
+			continue
+		}
+
+		// Markers without a length
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			out = append(out, data[i:i+2]...)
+			i += 2
+			continue
+		}
+
+		// The compressed image data and anything after it is copied as is
+		if marker == 0xDA || marker == 0xD9 {
+			if orientation > 1 && !wroteOrientation {
+				out = append(out, orientationSegment(orientation)...)
+			}
+			out = append(out, data[i:]...)
+			return out, stripped, nil
+		}
+
+		if i+4 > len(data) {
+			return data, false, ErrInvalid
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		if length < 2 || i+2+length > len(data) {
+			return data, false, ErrInvalid
+		}
+		segment := data[i : i+2+length]
+		payload := segment[4:]
+
+		switch marker {
+		case 0xE1, 0xE2, 0xED, 0xFE:
+			if marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+				if o := exifOrientation(payload[6:]); o > 1 {
+					orientation = o
+				}
+			}
+			stripped = true
+		default:
+			// Put the orientation right after JFIF, where readers expect EXIF
+			if orientation > 1 && !wroteOrientation && marker != 0xE0 {
+				out = append(out, orientationSegment(orientation)...)
+				wroteOrientation = true
+			}
+			out = append(out, segment...)
+		}
+
+		i += 2 + length
+	}
+}
+
+// exifOrientation returns the orientation tag of the first IFD of a TIFF structure, or 0.
+func exifOrientation(tiff []byte) uint16 {
+	if len(tiff) < 8 {
+		return 0
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset+2 > len(tiff) || offset < 8 {
+		return 0
+	}
+	count := int(order.Uint16(tiff[offset : offset+2]))
+	for n := 0; n < count; n++ {
+		entry := offset + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:entry+2]) == 0x0112 {
+			o := order.Uint16(tiff[entry+8 : entry+10])
+			if o > 8 {
+				return 0
+			}
+			return o
+		}
+	}
+	return 0
+}
+
+// orientationSegment returns an APP1 segment with an EXIF structure holding only the orientation.
+func orientationSegment(orientation uint16) []byte {
+	var tiff bytes.Buffer
+	tiff.WriteString("MM\x00\x2a")
+	binary.Write(&tiff, binary.BigEndian, uint32(8))      // offset of the first IFD
+	binary.Write(&tiff, binary.BigEndian, uint16(1))      // number of entries
+	binary.Write(&tiff, binary.BigEndian, uint16(0x0112)) // orientation tag
+	binary.Write(&tiff, binary.BigEndian, uint16(3))      // type SHORT
+	binary.Write(&tiff, binary.BigEndian, uint32(1))      // count
+	binary.Write(&tiff, binary.BigEndian, orientation)
+	binary.Write(&tiff, binary.BigEndian, uint16(0))
+	binary.Write(&tiff, binary.BigEndian, uint32(0)) // no next IFD
+
+	payload := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// pngMetadataChunks are removed by PNG. XMP is stored in an iTXt chunk.
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"iCCP": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+// PNG removes the EXIF, ICC profile, text (including XMP) and timestamp chunks of a PNG image.
+func PNG(data []byte) ([]byte, bool, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return data, false, ErrInvalid
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, pngSignature...)
+	stripped := false
+
+	i := len(pngSignature)
+	for i < len(data) {
+		if i+8 > len(data) {
+			return data, false, ErrInvalid
+		}
+		length := int(binary.BigEndian.Uint32(data[i : i+4]))
+		end := i + 12 + length
+		if length < 0 || end > len(data) || end < i {
+			return data, false, ErrInvalid
+		}
+		chunkType := string(data[i+4 : i+8])
+
+		if pngMetadataChunks[chunkType] {
+			stripped = true
+		} else {
+			out = append(out, data[i:end]...)
+		}
+
+		i = end
+		if chunkType == "IEND" {
+			break
+		}
+	}
+
+	return out, stripped, nil
+}
@@ -0,0 +1,295 @@
+package strip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for x := 0; x < 8; x++ {
+		for y := 0; y < 8; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 30), uint8(y * 30), 100, 255})
+		}
+	}
+	return img
+}
+
+// segment returns a JPEG segment with a marker and payload.
+func segment(marker byte, payload []byte) []byte {
+	s := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(s[2:], uint16(len(payload)+2))
+	return append(s, payload...)
+}
+
+// exifSegment returns an APP1 segment with a little endian EXIF structure holding a camera model
+// and an orientation.
+func exifSegment(orientation uint16) []byte {
+	var tiff bytes.Buffer
+	tiff.WriteString("II\x2a\x00")
+	binary.Write(&tiff, binary.LittleEndian, uint32(8))
+	binary.Write(&tiff, binary.LittleEndian, uint16(2))
+	// Model, an ASCII string stored after the IFD
+	binary.Write(&tiff, binary.LittleEndian, uint16(0x0110))
+	binary.Write(&tiff, binary.LittleEndian, uint16(2))
+	binary.Write(&tiff, binary.LittleEndian, uint32(12))
+	binary.Write(&tiff, binary.LittleEndian, uint32(8+2+2*12+4))
+	// Orientation
+	binary.Write(&tiff, binary.LittleEndian, uint16(0x0112))
+	binary.Write(&tiff, binary.LittleEndian, uint16(3))
+	binary.Write(&tiff, binary.LittleEndian, uint32(1))
+	binary.Write(&tiff, binary.LittleEndian, orientation)
+	binary.Write(&tiff, binary.LittleEndian, uint16(0))
+	binary.Write(&tiff, binary.LittleEndian, uint32(0))
+	tiff.WriteString("SecretCam 1\x00")
+	return segment(0xE1, append([]byte("Exif\x00\x00"), tiff.Bytes()...))
+}
+
+// testJPEG returns a JPEG with the given segments put right after the start of image marker.
+func testJPEG(t *testing.T, segments ...[]byte) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	out := append([]byte{}, data[:2]...)
+	for _, s := range segments {
+		out = append(out, s...)
+	}
+	return append(out, data[2:]...)
+}
+
+// findOrientation returns the orientation of the first EXIF segment of a JPEG, or 0.
+func findOrientation(data []byte) uint16 {
+	i := bytes.Index(data, []byte("Exif\x00\x00"))
+	if i < 0 {
+		return 0
+	}
+	return exifOrientation(data[i+6:])
+}
+
+func TestJPEG(t *testing.T) {
+	xmp := segment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>secret</x:xmpmeta>"))
+	icc := segment(0xE2, []byte("ICC_PROFILE\x00\x01\x01secret"))
+	iptc := segment(0xED, []byte("Photoshop 3.0\x00secret"))
+	comment := segment(0xFE, []byte("secret comment"))
+	data := testJPEG(t, segment(0xE0, []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")), exifSegment(6), xmp, icc, iptc, comment)
+
+	out, stripped, err := JPEG(data)
+	if err != nil {
+		t.Fatalf("JPEG = %v", err)
+	}
+	if !stripped {
+		t.Error("JPEG did not report metadata as stripped")
+	}
+	for _, secret := range []string{"SecretCam", "secret", "xmpmeta"} {
+		if bytes.Contains(out, []byte(secret)) {
+			t.Errorf("stripped image still contains %q", secret)
+		}
+	}
+	if o := findOrientation(out); o != 6 {
+		t.Errorf("orientation = %d, want 6", o)
+	}
+	// The orientation goes after JFIF, which has to stay the first segment
+	if !bytes.HasPrefix(out[2:], []byte{0xFF, 0xE0}) {
+		t.Error("JFIF is no longer the first segment")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("stripped image does not decode: %v", err)
+	}
+
+	// Stripping again keeps the orientation and removes nothing else
+	again, _, err := JPEG(out)
+	if err != nil || findOrientation(again) != 6 || len(again) != len(out) {
+		t.Errorf("stripping twice changed the image: %v", err)
+	}
+}
+
+func TestJPEGWithoutMetadata(t *testing.T) {
+	data := testJPEG(t)
+	out, stripped, err := JPEG(data)
+	if err != nil || stripped || !bytes.Equal(out, data) {
+		t.Errorf("JPEG changed an image without metadata: stripped %v, %v", stripped, err)
+	}
+}
+
+func TestJPEGNormalOrientation(t *testing.T) {
+	// An orientation of 1 is the default, so no EXIF is written for it
+	out, _, err := JPEG(testJPEG(t, exifSegment(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(out, []byte("Exif")) {
+		t.Error("stripped image has an EXIF segment for the default orientation")
+	}
+}
+
+func TestJPEGInvalid(t *testing.T) {
+	data := testJPEG(t, exifSegment(3))
+	sos := bytes.Index(data, []byte{0xFF, 0xDA})
+
+	// Cutting the image anywhere before the image data must fail without changing it
+	for n := 2; n < sos; n++ {
+		out, stripped, err := JPEG(data[:n])
+		if !errors.Is(err, ErrInvalid) || stripped || !bytes.Equal(out, data[:n]) {
+			t.Errorf("JPEG(data[:%d]) = %v, %v, want %v", n, stripped, err, ErrInvalid)
+		}
+	}
+
+	tests := map[string][]byte{
+		"not a jpeg":          []byte("GIF89a"),
+		"no marker":           {0xFF, 0xD8, 0x00, 0x01, 0x02, 0x03},
+		"length below two":    {0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x01, 0xFF, 0xD9},
+		"length past the end": {0xFF, 0xD8, 0xFF, 0xE1, 0xFF, 0xFF, 0x00, 0x00},
+		"missing length":      {0xFF, 0xD8, 0xFF, 0xE1, 0x00},
+	}
+	for name, data := range tests {
+		if _, _, err := JPEG(data); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: JPEG = %v, want %v", name, err, ErrInvalid)
+		}
+	}
+}
+
+func TestExifOrientation(t *testing.T) {
+	valid := exifSegment(8)[4+6:]
+	tests := map[string]struct {
+		tiff []byte
+		want uint16
+	}{
+		"little endian":    {valid, 8},
+		"big endian":       {orientationSegment(5)[4+6:], 5},
+		"short":            {valid[:6], 0},
+		"bad byte order":   {append([]byte("XX"), valid[2:]...), 0},
+		"truncated ifd":    {valid[:20], 0},
+		"offset past end":  {append(append([]byte{}, valid[:4]...), 0xFF, 0xFF, 0, 0), 0},
+		"offset in header": {append(append([]byte{}, valid[:4]...), 2, 0, 0, 0), 0},
+	}
+	for name, tt := range tests {
+		if got := exifOrientation(tt.tiff); got != tt.want {
+			t.Errorf("%s: exifOrientation = %d, want %d", name, got, tt.want)
+		}
+	}
+
+	// Values above 8 are not orientations
+	bad := append([]byte{}, valid...)
+	i := bytes.Index(bad, []byte{0x12, 0x01, 0x03, 0x00})
+	bad[i+8] = 9
+	if got := exifOrientation(bad); got != 0 {
+		t.Errorf("exifOrientation with value 9 = %d, want 0", got)
+	}
+}
+
+// chunk returns a PNG chunk with a valid CRC.
+func chunk(chunkType string, payload []byte) []byte {
+	c := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	c = append(c, chunkType...)
+	c = append(c, payload...)
+	return binary.BigEndian.AppendUint32(c, crc32.ChecksumIEEE(c[4:]))
+}
+
+// testPNG returns a PNG with the given chunks put right after IHDR.
+func testPNG(t *testing.T, chunks ...[]byte) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	ihdrEnd := len(pngSignature) + 12 + 13
+	out := append([]byte{}, data[:ihdrEnd]...)
+	for _, c := range chunks {
+		out = append(out, c...)
+	}
+	return append(out, data[ihdrEnd:]...)
+}
+
+func TestPNG(t *testing.T) {
+	data := testPNG(t,
+		chunk("tEXt", []byte("Author\x00secret")),
+		chunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00secret")),
+		chunk("zTXt", []byte("Comment\x00\x00secret")),
+		chunk("eXIf", []byte("MM\x00\x2asecret")),
+		chunk("iCCP", []byte("icc\x00\x00secret")),
+		chunk("tIME", []byte{0x07, 0xE8, 1, 2, 3, 4, 5}),
+		chunk("pHYs", []byte{0, 0, 0x0B, 0x13, 0, 0, 0x0B, 0x13, 1}),
+	)
+
+	out, stripped, err := PNG(data)
+	if err != nil {
+		t.Fatalf("PNG = %v", err)
+	}
+	if !stripped {
+		t.Error("PNG did not report metadata as stripped")
+	}
+	for _, name := range []string{"tEXt", "iTXt", "zTXt", "eXIf", "iCCP", "tIME", "secret"} {
+		if bytes.Contains(out, []byte(name)) {
+			t.Errorf("stripped image still contains %q", name)
+		}
+	}
+	if !bytes.Contains(out, []byte("pHYs")) {
+		t.Error("stripped image lost its pHYs chunk")
+	}
+
+	// The chunks that are kept are copied with their CRC, which the decoder checks
+	img, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("stripped image does not decode: %v", err)
+	}
+	if img.At(3, 5) != testImage().At(3, 5) {
+		t.Error("stripping changed the pixels")
+	}
+}
+
+func TestPNGTrailingData(t *testing.T) {
+	// Anything after IEND is dropped
+	data := append(testPNG(t), "trailing"...)
+	out, _, err := PNG(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.HasSuffix(out, []byte("trailing")) {
+		t.Error("data after IEND was kept")
+	}
+}
+
+func TestPNGInvalid(t *testing.T) {
+	data := testPNG(t, chunk("tEXt", []byte("Author\x00secret")))
+	textStart := len(pngSignature) + 12 + 13
+
+	// Cutting the image inside a chunk must fail without changing it
+	for n := textStart + 1; n < textStart+12+len("Author\x00secret"); n++ {
+		out, stripped, err := PNG(data[:n])
+		if !errors.Is(err, ErrInvalid) || stripped || !bytes.Equal(out, data[:n]) {
+			t.Errorf("PNG(data[:%d]) = %v, %v, want %v", n, stripped, err, ErrInvalid)
+		}
+	}
+
+	huge := append([]byte{}, data...)
+	binary.BigEndian.PutUint32(huge[textStart:], 0xFFFFFFFF)
+	if _, _, err := PNG(huge); !errors.Is(err, ErrInvalid) {
+		t.Errorf("PNG with a huge chunk length = %v, want %v", err, ErrInvalid)
+	}
+	if _, _, err := PNG([]byte("\x89PNG\r\n")); !errors.Is(err, ErrInvalid) {
+		t.Errorf("PNG with a short signature = %v, want %v", err, ErrInvalid)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	gif := []byte("GIF89a\x01\x00\x01\x00")
+	out, stripped, err := Metadata(gif)
+	if err != nil || stripped || !bytes.Equal(out, gif) {
+		t.Errorf("Metadata changed a GIF: stripped %v, %v", stripped, err)
+	}
+	if _, stripped, err := Metadata(testJPEG(t, exifSegment(1))); err != nil || !stripped {
+		t.Errorf("Metadata(jpeg) = %v, %v, want stripped", stripped, err)
+	}
+	if _, stripped, err := Metadata(testPNG(t, chunk("tEXt", []byte("a\x00b")))); err != nil || !stripped {
+		t.Errorf("Metadata(png) = %v, %v, want stripped", stripped, err)
+	}
+}
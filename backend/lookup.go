@@ -0,0 +1,150 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// LookupResult is the answer for one hash sent to /lookup.
+type LookupResult struct {
+	Hash     string `json:"hash"`
+	Exists   bool   `json:"exists"`
+	SHA256   string `json:"sha256,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Uploaded int64  `json:"uploaded,omitempty"`
+}
+
+// hashColumn returns the column of the data table a hash is looked up in, based on its length.
+// crc32 hashes are stored without leading zeros, so they can be shorter than 8 characters.
+func hashColumn(h string) string {
+	if h == "" || strings.Trim(h, "0123456789abcdef") != "" {
+		return ""
+	}
+	switch {
+	case len(h) == 64:
+		return "sha256"
+	case len(h) == 40:
+		return "sha1"
+	case len(h) == 32:
+		return "md5"
+	case len(h) <= 8:
+		return "crc32"
+	}
+	return ""
+}
+
+// lookupHashes looks up hashes of any supported algorithm, with one query per algorithm. Files whose
+// data is missing from storage, like quarantined files, are reported as not existing.
+func lookupHashes(hashes []string) ([]LookupResult, error) {
+	results := make([]LookupResult, len(hashes))
+	keys := make([]string, len(hashes))
+	byColumn := map[string][]string{}
+	for i, h := range hashes {
+		h = strings.ToLower(strings.TrimSpace(h))
+		results[i].Hash = h
+		column := hashColumn(h)
+		if column == "" {
+			continue
+		}
+		if column == "crc32" {
+			h = strings.TrimLeft(h, "0")
+			if h == "" {
+				h = "0"
+			}
+		}
+		keys[i] = h
+		byColumn[column] = append(byColumn[column], h)
+	}
+
+	found := map[string]LookupResult{}
+	for column, values := range byColumn {
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")
+		args := make([]interface{}, len(values))
+		for i, v := range values {
+			args[i] = v
+		}
+
+		query := fmt.Sprintf("SELECT %s, sha256, size, type, uploaded FROM data WHERE %s IN (%s)", column, column, placeholders)
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var key string
+			var result LookupResult
+			var size sql.NullInt64
+			var contentType sql.NullString
+			if err := rows.Scan(&key, &result.SHA256, &size, &contentType, &result.Uploaded); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			result.Size = size.Int64
+			result.Type = contentType.String
+			if _, ok := found[key]; !ok {
+				found[key] = result
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range results {
+		result, ok := found[keys[i]]
+		if keys[i] == "" || !ok {
+			continue
+		}
+		if _, err := resolveBlob(result.SHA256); err != nil {
+			continue
+		}
+		result.Hash = results[i].Hash
+		result.Exists = true
+		results[i] = result
+	}
+	return results, nil
+}
+
+// handleLookup checks which of a batch of hashes are stored, so clients can skip uploading them.
+func handleLookup(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w, r, apiCors)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Hashes []string `json:"hashes"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4*1024*1024)).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(request.Hashes) == 0 {
+		http.Error(w, "No hashes provided", http.StatusBadRequest)
+		return
+	}
+	if len(request.Hashes) > *lookupMax {
+		http.Error(w, fmt.Sprintf("Too many hashes, at most %d can be looked up at once", *lookupMax), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	results, err := lookupHashes(request.Hashes)
+	if err != nil {
+		logger.Println("Failed to look up hashes", err)
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Results []LookupResult `json:"results"`
+	}{results})
+}
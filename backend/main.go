@@ -7,14 +7,14 @@ import (
 	"embed"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"hash/crc32"
-	"hash/crc64"
 	"io"
 	"io/fs"
 	"log"
-	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
@@ -40,6 +40,7 @@ import (
 
 	"github.com/hexahigh/go-lib/sniff"
 	"github.com/hexahigh/yapc/backend/lib/hash"
+	"github.com/hexahigh/yapc/backend/lib/strip"
 	"github.com/peterbourgon/ff"
 )
 
@@ -65,6 +66,55 @@ var (
 	waitForIt            = flag.Bool("wfi", false, "Wait for the database to be initialized")
 	printLicense         = flag.Bool("l", false, "Print license")
 	maxFileSize          = flag.Int64("maxfilesize", 1024*1024*1024*2, "Max file size in bytes")
+	adminToken           = flag.String("admin:token", "", "Bearer token for the admin API, the admin API is disabled if empty")
+	blocklistImport      = flag.String("blocklist:import", "", "Import a hash list into the blocklist on startup")
+	blocklistDistance    = flag.Int("blocklist:distance", 10, "Default max Hamming distance for perceptual blocklist entries")
+	jobWorkers           = flag.Int("jobs:workers", runtime.NumCPU(), "Number of workers each background job uses")
+	doScrub              = flag.Bool("scrub", false, "Check for orphaned, missing and corrupt files, print a JSON report and exit")
+	scrubRepair          = flag.Bool("scrub:repair", false, "Repair the problems found by -scrub instead of only reporting them")
+	scrubMirror          = flag.String("scrub:mirror", "", "Yapc instance to fetch good copies of missing or corrupt files from")
+	scrubReport          = flag.String("scrub:report", "", "File to write the -scrub report to instead of stdout")
+	exportFile           = flag.String("export", "", "Write every file, short link and their database entries to an archive and exit, gzipped if the name ends with .gz")
+	exportSince          = flag.String("export:since", "", "Only export files and short links added since a unix time, RFC3339 time or date")
+	importFile           = flag.String("import", "", "Import an archive made with -export and exit")
+	migrateLayoutFlag    = flag.Bool("migrate:layout", false, "Move files from the flat data folder layout into the sharded layout and exit")
+	ipSaltFlag           = flag.String("ip:salt", "", "Salt for hashing client IPs, a random salt is stored in the database if empty")
+	trustProxy           = flag.Bool("trustproxy", false, "Use the X-Forwarded-For and X-Real-IP headers to get the client IP")
+	contentHost          = flag.String("content:host", "", "Hostname uploaded files are served on, the API refuses requests to it. Files are served on every host if empty")
+	corsAPI              = flag.String("cors:api", "*", "Comma separated origins allowed to use the API, * allows every origin")
+	corsContent          = flag.String("cors:content", "*", "Comma separated origins allowed to fetch uploaded files, * allows every origin")
+	corsAdmin            = flag.String("cors:admin", "", "Comma separated origins allowed to use the admin API, no CORS headers are sent if empty")
+	signKey              = flag.String("sign:key", "", "Secret key for signed download links, signing is disabled if empty")
+	signRequire          = flag.Bool("sign:require", false, "Reject downloads without a valid signature")
+	signMaxAge           = flag.Duration("sign:maxage", 24*time.Hour, "How long signed links made by /admin/sign are valid by default")
+	imgMaxSize           = flag.Int("img:maxsize", 4096, "Max width and height of images made by /img")
+	imgMaxPixels         = flag.Int64("img:maxpixels", 50_000_000, "Max number of pixels of images /img will decode")
+	imgCacheLimit        = flag.Int64("img:cache", 1024*1024*1024, "Max size of the /img cache in bytes")
+	stripMetadata        = flag.Bool("strip:metadata", false, "Strip EXIF, XMP and ICC metadata from every JPEG and PNG upload")
+	stripMaxSize         = flag.Int64("strip:maxsize", 64*1024*1024, "Max size in bytes of JPEG and PNG uploads metadata is stripped from, larger ones are refused")
+	pasteMaxSize         = flag.Int64("paste:maxsize", 10*1024*1024, "Max paste size in bytes")
+	albumMaxFiles        = flag.Int("album:maxfiles", 1000, "Max number of files in an album")
+	bundleMaxFiles       = flag.Int("bundle:maxfiles", 1000, "Max number of files in a /bundle download")
+	bundleMaxSize        = flag.Int64("bundle:maxsize", 1024*1024*1024*10, "Max total size of the files in a /bundle download in bytes")
+	clickRetention       = flag.Duration("clicks:retention", 90*24*time.Hour, "How long clicks of short links are kept for statistics, 0 keeps them forever")
+	lookupMax            = flag.Int("lookup:max", 1000, "Max number of hashes that can be looked up at once with /lookup")
+	shortenSchemes       = flag.String("shorten:schemes", "http,https", "Comma separated URL schemes short links may point to")
+	shortenBlocklist     = flag.String("shorten:blocklist", "", "File with domains short links may not point to and /fetch may not download from, one per line. Reloaded when it changes")
+	shortenPrivate       = flag.Bool("shorten:private", false, "Allow short links to private, loopback and link-local addresses")
+	shortenPreview       = flag.Bool("shorten:preview", false, "Show a preview page with the destination instead of redirecting right away")
+	shortenLength        = flag.Int("shorten:length", 7, "Length of random short link ids")
+	publicURL            = flag.String("public:url", "", "Public base URL used in links to uploaded files, like https://files.example.com. Guessed from the request if empty")
+	fetchMaxSize         = flag.Int64("fetch:maxsize", 1024*1024*512, "Max size in bytes of a file downloaded with /fetch")
+	fetchTimeout         = flag.Duration("fetch:timeout", time.Minute, "Max time a download with /fetch may take")
+	fetchRedirects       = flag.Int("fetch:redirects", 5, "Max redirects followed by /fetch")
+	fetchWorkers         = flag.Int("fetch:workers", 4, "Number of downloads /fetch runs at the same time")
+	fetchPrivate         = flag.Bool("fetch:private", false, "Allow /fetch to download from private, loopback and link-local addresses")
+	replicatePeers       = flag.String("replicate:peers", "", "Comma separated base URLs of yapc instances to replicate new files from")
+	replicateToken       = flag.String("replicate:token", "", "Bearer token for the replication API, shared with the peers. Replication is disabled if empty")
+	replicateInterval    = flag.Duration("replicate:interval", 30*time.Second, "How often peers are checked for new files")
+	replicateFallback    = flag.Bool("replicate:fallback", false, "Fetch files that are not stored here from the peers when they are requested")
+	ctAllow              = flag.String("ct:allow", "image/*,video/*,audio/*,text/plain,application/pdf,application/octet-stream", "Comma separated content types /get2 may serve with the ct parameter, * is a wildcard")
+	gcQuarantine         = flag.Duration("gc:quarantine", 30*24*time.Hour, "How long quarantined files are kept before the gc job deletes them")
 )
 
 var db *sql.DB
@@ -87,6 +137,21 @@ func main() {
 
 	logger = log.New(os.Stdout, "", log.LstdFlags)
 
+	initCors()
+
+	if *signRequire && *signKey == "" {
+		log.Fatal("-sign:require needs a -sign:key")
+	}
+	if *shortenLength < 4 || *shortenLength > 64 {
+		log.Fatal("-shorten:length must be between 4 and 64")
+	}
+	if *shortenBlocklist != "" {
+		if err := loadDomainBlocklist(); err != nil {
+			log.Fatalf("Failed to load domain blocklist: %v", err)
+		}
+		go watchDomainBlocklist()
+	}
+
 	if *printLicense {
 		license, err := fs.ReadFile(licenseFS, "LICENSE")
 		if err != nil {
@@ -139,43 +204,123 @@ func main() {
 
 	logLevelln(1, "Running initDB")
 	initDB()
+	initIPSalt()
+
+	if *blocklistImport != "" {
+		importBlocklistFile(*blocklistImport)
+	}
+
+	logLevelln(1, "Running onStart")
+	onStart()
+
+	if *migrateLayoutFlag {
+		runMigrateLayout()
+		return
+	}
+
+	if *doScrub {
+		runScrub()
+		return
+	}
+
+	if *exportFile != "" {
+		runExport()
+		return
+	}
+
+	if *importFile != "" {
+		runImport()
+		return
+	}
+
+	logLevelln(1, "Resuming interrupted jobs")
+	resumeJobs()
+	go trimImageCache()
+	go expirePastes()
+	go expireChallenges()
+	go recordClicks()
+	go pruneClicks()
+	if !*disableUpload {
+		startFetchWorkers()
+	}
+	if *replicateToken != "" {
+		followPeers()
+	}
 
 	if *fixDb {
-		dbFixer()
+		if _, err := startJob("fixdb", *fixDb_dry); err != nil {
+			logger.Println("Failed to start fixdb:", err)
+		}
 	}
 
 	if *doResniff {
-		resniff()
+		if _, err := startJob("resniff", false); err != nil {
+			logger.Println("Failed to start resniff:", err)
+		}
 	}
 
-	logLevelln(1, "Running onStart")
-	onStart()
-
 	fmt.Println("Started")
 	fmt.Println("Listening on port", *port)
 
-	http.HandleFunc("/exists", handleExists)
-	http.HandleFunc("/get/", handleGet)
-	http.HandleFunc("/get2/", handleGet2)
-	http.HandleFunc("/stats", handleStats)
+	http.HandleFunc("/exists", apiRoute(handleExists))
+	http.HandleFunc("/lookup", apiRoute(handleLookup))
+	http.HandleFunc("/get/", contentRoute(handleGet))
+	http.HandleFunc("/get2/", contentRoute(handleGet2))
+	http.HandleFunc("/img/", contentRoute(handleImage))
+	http.HandleFunc("/p/", contentRoute(handlePasteView))
+	http.HandleFunc("/raw/", contentRoute(handlePasteRaw))
+	http.HandleFunc("/zip/", contentRoute(handleAlbumZip))
+	http.HandleFunc("/bundle", apiRoute(handleBundle))
+	http.HandleFunc("/album", apiRoute(handleAlbum))
+	http.HandleFunc("/album/", apiRoute(handleAlbum))
+	http.HandleFunc("/stats", apiRoute(handleStats))
 	http.HandleFunc("/ping", handlePing)
 	http.HandleFunc("/health", handleHealth)
-	http.HandleFunc("/u/", handleU)
+	http.HandleFunc("/u/", apiRoute(handleU))
+	http.HandleFunc("/qr/", apiRoute(handleQR))
 	http.HandleFunc("/load", handleLoad)
 
 	if !*disableUpload {
-		http.HandleFunc("/store", handleStore)
+		http.HandleFunc("/store", apiRoute(handleStore))
+		http.HandleFunc("/store/declare", apiRoute(handleDeclare))
+		http.HandleFunc("/store/prove", apiRoute(handleProve))
+		http.HandleFunc("/paste", apiRoute(handlePaste))
+		http.HandleFunc("/upload.php", apiRoute(handleUploadPHP))
+		http.HandleFunc("/fetch", apiRoute(handleFetch))
+		http.HandleFunc("/fetch/", apiRoute(handleFetchStatus))
 	}
 
 	if !*disableShorten {
-		http.HandleFunc("/shorten", handleShorten)
+		http.HandleFunc("/shorten", apiRoute(handleShorten))
+		http.HandleFunc("/shorten/", apiRoute(handleShortLink))
+	}
+
+	if *replicateToken != "" {
+		http.HandleFunc("/replicate/changes", apiRoute(handleChanges))
+		http.HandleFunc("/replicate/blob/", apiRoute(handleReplicaBlob))
+	}
+
+	if *adminToken != "" {
+		http.HandleFunc("/admin/blocklist", apiRoute(handleAdminBlocklist))
+		http.HandleFunc("/admin/blocklist/import", apiRoute(handleAdminBlocklistImport))
+		http.HandleFunc("/admin/uploads", apiRoute(handleAdminUploads))
+		http.HandleFunc("/admin/uploads/quarantine", apiRoute(handleAdminQuarantine))
+		http.HandleFunc("/admin/uploads/restore", apiRoute(handleAdminRestore))
+		http.HandleFunc("/admin/uploads/block", apiRoute(handleAdminBlock))
+		http.HandleFunc("/admin/urls", apiRoute(handleAdminURLs))
+		http.HandleFunc("/admin/jobs", apiRoute(handleAdminJobs))
+		http.HandleFunc("/admin/scrub", apiRoute(handleAdminScrub))
+
+		if *signKey != "" {
+			http.HandleFunc("/admin/sign", apiRoute(handleAdminSign))
+		}
 	}
 
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))
 }
 
 func handleExists(w http.ResponseWriter, r *http.Request) {
-	enableCors(&w)
+	enableCors(&w, r, apiCors)
 	if r.Method == "OPTIONS" {
 		return
 	}
@@ -192,51 +337,29 @@ func handleExists(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cleanHash := filepath.Clean(request.ID)
-	if cleanHash != request.ID {
-		http.Error(w, "Invalid hash", http.StatusBadRequest)
-		logger.Println("An invalid hash was provided, perhaps someone tried to access files outside of the data folder." + request.ID)
+	results, err := lookupHashes([]string{request.ID})
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
 		return
 	}
 
-	file := filepath.Join(*dataDir, cleanHash)
-	_, err := os.Stat(file)
-	if err == nil {
-		response := map[string]interface{}{
-			"success": true,
-			"error":   err,
-			"id":      request.ID,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
-		return
-	} else {
-		response := map[string]interface{}{
-			"success": false,
-			"error":   err,
-			"id":      request.ID,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
-		return
+	response := map[string]interface{}{
+		"success": results[0].Exists,
+		"error":   "",
+		"id":      request.ID,
+	}
+	if !results[0].Exists {
+		response["error"] = "File not found"
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
 
 func handleStore(w http.ResponseWriter, r *http.Request) {
 	atomic.AddInt64(&uploadCount, 1)
 	defer atomic.AddInt64(&uploadCount, -1)
 
-	type StoreResponse struct {
-		SHA256 string `json:"sha256"`
-		SHA1   string `json:"sha1"`
-		MD5    string `json:"md5"`
-		CRC32  string `json:"crc32"`
-		AHash  string `json:"ahash"`
-		DHash  string `json:"dhash"`
-		Type   string `json:"type"`
-	}
-
-	enableCors(&w)
+	enableCors(&w, r, apiCors)
 	if r.Method == "OPTIONS" {
 		return
 	}
@@ -247,94 +370,189 @@ func handleStore(w http.ResponseWriter, r *http.Request) {
 
 	r.Body = http.MaxBytesReader(w, r.Body, *maxFileSize)
 
-	file, _, err := r.FormFile("file")
-	if err != nil {
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
 		// Check if the error is due to the file size exceeding the limit
-		if err.Error() == "http: request body too large" {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
 			http.Error(w, "File size too large", http.StatusRequestEntityTooLarge)
 		} else {
 			http.Error(w, "Failed to retrieve file", http.StatusBadRequest)
 		}
 		return
 	}
+
+	// Several files uploaded as files[] are stored as an album
+	if headers := r.MultipartForm.File["files[]"]; len(headers) > 0 {
+		storeAlbumUpload(w, r, headers)
+		return
+	}
+
+	headers := r.MultipartForm.File["file"]
+	if len(headers) == 0 {
+		http.Error(w, "Failed to retrieve file", http.StatusBadRequest)
+		return
+	}
+
+	response, created, err := storeUpload(r, headers[0])
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+
+	// Set the content type to application/json
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+var (
+	errStrip         = errors.New("failed to strip metadata")
+	errStripTooLarge = errors.New("image is too large to strip metadata from")
+)
+
+// storeUpload stores a file uploaded to /store and records the upload. created is false if the
+// file already existed.
+func storeUpload(r *http.Request, header *multipart.FileHeader) (StoreResponse, bool, error) {
+	file, err := header.Open()
+	if err != nil {
+		return StoreResponse{}, false, fmt.Errorf("failed to open upload: %v", err)
+	}
 	defer file.Close()
 
+	// strip is only read from the query, a form field would be seen after the file was buffered
+	stripFile := *stripMetadata || parseBool(r.URL.Query().Get("strip"))
+	if stripFile {
+		// Only images are stripped, and they are held in memory twice while that happens
+		prefix := make([]byte, 8)
+		n, _ := io.ReadFull(file, prefix)
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return StoreResponse{}, false, fmt.Errorf("failed to read file: %v", err)
+		}
+		stripFile = strip.Supported(prefix[:n])
+		if stripFile && header.Size > *stripMaxSize {
+			return StoreResponse{}, false, errStripTooLarge
+		}
+	}
+
 	// Create a buffer to hold the file data
 	buf := new(bytes.Buffer)
 	if _, err := io.Copy(buf, file); err != nil {
-		http.Error(w, "Failed to read file", http.StatusInternalServerError)
-		return
+		return StoreResponse{}, false, fmt.Errorf("failed to read file: %v", err)
 	}
 
 	logLevelln(1, "Something was uploaded")
 
-	// Create a wait group to wait for all hash computations to finish
-	var wg sync.WaitGroup
-	var mu sync.Mutex
-	hashes := make(map[string]string)
+	// Strip metadata before hashing, so the hashes are those of the stored file
+	data := buf.Bytes()
+	stripped := false
+	if stripFile {
+		data, stripped, err = strip.Metadata(data)
+		if err != nil {
+			return StoreResponse{}, false, errStrip
+		}
+	}
 
-	logLevelln(1, "Computing hashes")
+	hashes, contentType, created, err := storeBlob(data)
+	if err != nil {
+		return StoreResponse{}, false, err
+	}
 
-	// Define a function to compute a hash and store it in the map
-	computeHash := func(hashFunc crypto.Hash, hashKey string) {
-		logLevelln(1, "Computing "+hashKey)
-		defer wg.Done()
-		hasher := hashFunc.New()
-		hasher.Write(buf.Bytes())
-		hash := hex.EncodeToString(hasher.Sum(nil))
-		mu.Lock()
-		hashes[hashKey] = hash
-		mu.Unlock()
-		logLevelln(1, "Computed "+hashKey)
+	// Record the upload event with the original filename, even if the data is already stored
+	if err := recordUpload(r, header, hashes["sha256"], contentType); err != nil {
+		logger.Println("Failed to record upload", err)
 	}
 
-	// Compute SHA256, SHA1, MD5, and CRC32 hashes concurrently
-	wg.Add(3)
-	go computeHash(crypto.SHA256, "sha256")
-	go computeHash(crypto.SHA1, "sha1")
-	go computeHash(crypto.MD5, "md5")
-	wg.Wait()
+	return StoreResponse{
+		SHA256:   hashes["sha256"],
+		SHA1:     hashes["sha1"],
+		MD5:      hashes["md5"],
+		CRC32:    hashes["crc32"],
+		AHash:    hashes["ahash"],
+		DHash:    hashes["dhash"],
+		Type:     contentType,
+		Stripped: stripped,
+	}, created, nil
+}
 
-	// Compute CRC32 hash
-	crc32Hasher := crc32.NewIEEE()
-	crc32Hasher.Write(buf.Bytes())
-	hashes["crc32"] = fmt.Sprintf("%x", crc32Hasher.Sum32())
+// storeError responds to a request whose upload could not be stored.
+func storeError(w http.ResponseWriter, err error) {
+	switch err {
+	case errBlocked:
+		http.Error(w, "This file has been blocked", http.StatusUnavailableForLegalReasons)
+	case errStrip:
+		http.Error(w, "Failed to strip metadata", http.StatusUnprocessableEntity)
+	case errStripTooLarge:
+		http.Error(w, "Image too large to strip metadata", http.StatusRequestEntityTooLarge)
+	default:
+		logger.Println("Failed to store file", err)
+		http.Error(w, "Failed to store file", http.StatusInternalServerError)
+	}
+}
 
-	// Use SHA256 hash as the filename
-	filename := *dataDir + "/" + hashes["sha256"]
+// resolveHash returns the sha256 and sniffed type of the file with the given sha256, sha1, md5 or
+// crc32 hash. It returns sql.ErrNoRows if there is no such file.
+func resolveHash(h string) (string, string, error) {
+	var sha256Hash string
+	var contentType sql.NullString
+	err := db.QueryRow("SELECT sha256, type FROM data WHERE sha256 = ? OR sha1 = ? OR md5 = ? OR crc32 = ?", h, h, h, h).Scan(&sha256Hash, &contentType)
+	return sha256Hash, contentType.String, err
+}
 
-	// Get the filetype based on magic number
-	logLevelln(1, "Getting filetype")
-	contentType := sniff.DetectContentType(buf.Bytes())
+var errBlocked = errors.New("file is blocked")
 
-	if contentType == "image/jpeg" || contentType == "image/png" || contentType == "image/gif" {
-		logLevelln(1, "Detected image, computing Ahash and Dhash")
-		// Decode the image from the buffer
-		img, _, err := image.Decode(bytes.NewReader(buf.Bytes()))
+// storeBlob hashes data and stores it under its sha256, unless a file with the same content already
+// exists. It returns errBlocked if the data matches the blocklist or has been quarantined, and created
+// is false if the file already existed.
+func storeBlob(data []byte) (hashes map[string]string, contentType string, created bool, err error) {
+	hashes, contentType = computeHashes(data)
+	created, err = saveBlob(hashes, contentType, int64(len(data)), func(filename string) error {
+		newFile, err := os.Create(filename)
 		if err != nil {
-			logger.Println("Failed to decode image", err)
+			return fmt.Errorf("failed to create file: %v", err)
 		}
+		defer newFile.Close()
 
-		// Choose the hash length
-		hashLen := 32
-
-		// Hash the image with Ahash
-		ahashBytes, err := hash.Ahash(img, hashLen)
-		if err != nil {
-			logger.Println("Failed to generate Ahash", err)
+		// Write the file data to the new file
+		if _, err := newFile.Write(data); err != nil {
+			return fmt.Errorf("failed to save file: %v", err)
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", false, err
+	}
+	return hashes, contentType, created, nil
+}
 
-		// Hash the image with Dhash
-		dhashBytes, err := hash.Dhash(img, hashLen)
-		if err != nil {
-			logger.Println("Failed to generate Dhash", err)
-		}
-		dHash := hex.EncodeToString(dhashBytes)
-		aHash := hex.EncodeToString(ahashBytes)
+// saveBlob stores a file that has already been hashed, like storeBlob. save writes the file to the
+// path it is stored at, and is not called if the file already exists.
+func saveBlob(hashes map[string]string, contentType string, size int64, save func(filename string) error) (created bool, err error) {
+	// Use SHA256 hash as the filename
+	filename := blobPath(hashes["sha256"])
 
-		hashes["dhash"] = dHash
-		hashes["ahash"] = aHash
+	// Refuse the upload if it matches an entry in the blocklist
+	blocked, reason, err := checkBlocked(hashes)
+	if err != nil {
+		return false, fmt.Errorf("failed to check blocklist: %v", err)
+	}
+	if blocked {
+		logLevelln(0, "Refused upload of blocked file "+hashes["sha256"]+": "+reason)
+		return false, errBlocked
+	}
 
+	// Uploading a quarantined file again must not bring it back
+	quarantined, err := isQuarantined(hashes["sha256"])
+	if err != nil {
+		return false, fmt.Errorf("failed to check quarantine: %v", err)
+	}
+	if quarantined {
+		logLevelln(0, "Refused upload of quarantined file "+hashes["sha256"])
+		return false, errBlocked
 	}
 
 	absolutePath, err := filepath.Abs(filename)
@@ -358,75 +576,51 @@ func handleStore(w http.ResponseWriter, r *http.Request) {
 	go runOnUpload(args)
 
 	// Check if file already exists
-	_, err = os.Stat(filename)
-	if err == nil {
-		// File already exists, return the JSON object with all hashes
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		response := StoreResponse{
-			SHA256: hashes["sha256"],
-			SHA1:   hashes["sha1"],
-			MD5:    hashes["md5"],
-			CRC32:  hashes["crc32"],
-			AHash:  hashes["ahash"],
-			DHash:  hashes["dhash"],
-			Type:   contentType,
-		}
-		json.NewEncoder(w).Encode(response)
-
-		return
+	if _, err := resolveBlob(hashes["sha256"]); err == nil {
+		return false, nil
 	}
 
 	logLevelln(1, "Saving file")
 
-	newFile, err := os.Create(filename)
+	filename, err = prepareBlobPath(hashes["sha256"])
 	if err != nil {
-		http.Error(w, "Failed to create file", http.StatusInternalServerError)
-		return
+		return false, fmt.Errorf("failed to create file: %v", err)
 	}
-	defer newFile.Close()
 
-	// Write the file data to the new file
-	if _, err := buf.WriteTo(newFile); err != nil {
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
-		return
+	if err := save(filename); err != nil {
+		return false, err
 	}
 
-	logLevelln(1, "Storing hashes in database")
-
-	// Write the hashes and the current Unix time to the "data" table in the database
-	_, err = db.Exec(`INSERT INTO data (id, sha256, sha1, md5, crc32, ahash, dhash, type, uploaded) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		hashes["sha256"], hashes["sha256"], hashes["sha1"], hashes["md5"], hashes["crc32"], hashes["ahash"], hashes["dhash"], contentType, time.Now().Unix())
-	if err != nil {
-		http.Error(w, "Failed to store hashes in database", http.StatusInternalServerError)
-		return
+	// The database entry is kept if only the file was missing
+	var exists int
+	if err := db.QueryRow("SELECT COUNT(*) FROM data WHERE id = ?", hashes["sha256"]).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to query database: %v", err)
+	}
+	if exists > 0 {
+		return false, nil
 	}
 
-	// Set the content type to application/json
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
+	logLevelln(1, "Storing hashes in database")
 
-	response := StoreResponse{
-		SHA256: hashes["sha256"],
-		SHA1:   hashes["sha1"],
-		MD5:    hashes["md5"],
-		CRC32:  hashes["crc32"],
-		AHash:  hashes["ahash"],
-		DHash:  hashes["dhash"],
-		Type:   contentType,
+	// Write the hashes and the current Unix time to the "data" table in the database
+	if err := insertData(hashes, contentType, size, time.Now().Unix()); err != nil {
+		return false, fmt.Errorf("failed to store hashes in database: %v", err)
 	}
 
-	json.NewEncoder(w).Encode(response)
+	return true, nil
 }
 
 func handleGet(w http.ResponseWriter, r *http.Request) {
 	atomic.AddInt64(&downloadCount, 1)
 	defer atomic.AddInt64(&downloadCount, -1)
 
-	enableCors(&w)
+	enableCors(&w, r, contentCors)
 	if r.Method == "OPTIONS" {
 		return
 	}
+	if !requireSignature(w, r) {
+		return
+	}
 	hash := r.URL.Path[len("/get/"):]
 
 	cleanHash := filepath.Clean(hash)
@@ -436,17 +630,29 @@ func handleGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	filename := filepath.Join(*dataDir, hash)
-
 	fmt.Println("GET", r.URL.Path)
-	fmt.Println("Attempting to get", filename)
 
-	_, err := os.Stat(filename)
+	blocked, _, err := blockedByID(hash)
+	if err != nil {
+		http.Error(w, "Failed to check blocklist", http.StatusInternalServerError)
+		return
+	}
+	if blocked {
+		http.Error(w, "This file has been blocked", http.StatusUnavailableForLegalReasons)
+		return
+	}
+
+	filename, err := resolveBlob(hash)
+	if os.IsNotExist(err) && *replicateFallback && isSHA256(hash) && fetchFromPeers(hash) {
+		filename, err = resolveBlob(hash)
+	}
 	if os.IsNotExist(err) {
 		http.NotFound(w, r)
 		return
 	}
 
+	fmt.Println("Attempting to get", filename)
+
 	file, err := os.Open(filename)
 	if err != nil {
 		http.Error(w, "Failed to open file", http.StatusInternalServerError)
@@ -454,6 +660,12 @@ func handleGet(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
+	contentType, err := storedType(hash)
+	if err != nil {
+		logger.Println("Failed to query content type", err)
+	}
+	setContentHeaders(w, contentType, "", false)
+
 	_, err = io.Copy(w, file)
 	if err != nil {
 		http.Error(w, "Failed to send file", http.StatusInternalServerError)
@@ -465,10 +677,13 @@ func handleGet2(w http.ResponseWriter, r *http.Request) {
 	atomic.AddInt64(&downloadCount, 1)
 	defer atomic.AddInt64(&downloadCount, -1)
 
-	enableCors(&w)
+	enableCors(&w, r, contentCors)
 	if r.Method == "OPTIONS" {
 		return
 	}
+	if !requireSignature(w, r) {
+		return
+	}
 
 	var filename string
 
@@ -500,19 +715,13 @@ func handleGet2(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// If no extension is provided, default to 'bin'
-	if p.Ext == "" {
-		p.Ext = "bin"
-	}
-
-	// If no filename is provided, default to 'file.bin'
-	if p.Filename == "" {
-		p.Filename = "file.bin"
+	if p.ContentType != "" && !contentTypeAllowed(p.ContentType) {
+		http.Error(w, "Content type not allowed", http.StatusBadRequest)
+		return
 	}
 
-	// Query the database for the SHA256 hash associated with the provided hash
-	var sha256Hash string
-	err := db.QueryRow("SELECT sha256 FROM data WHERE sha256 = ? OR sha1 = ? OR md5 = ? OR crc32 = ?", p.Hash, p.Hash, p.Hash, p.Hash).Scan(&sha256Hash)
+	// Query the database for the SHA256 hash and sniffed type associated with the provided hash
+	sha256Hash, sniffedType, err := resolveHash(p.Hash)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			http.NotFound(w, r)
@@ -523,18 +732,26 @@ func handleGet2(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Construct the filename using the SHA256 hash
-	filename = filepath.Join(*dataDir, sha256Hash)
-
-	fmt.Println("GET", r.URL.Path)
-	fmt.Println("Attempting to get", filename)
+	blocked, _, err := blockedByID(sha256Hash)
+	if err != nil {
+		http.Error(w, "Failed to check blocklist", http.StatusInternalServerError)
+		return
+	}
+	if blocked {
+		http.Error(w, "This file has been blocked", http.StatusUnavailableForLegalReasons)
+		return
+	}
 
-	_, err = os.Stat(filename)
+	// Find the file using the SHA256 hash
+	filename, err = resolveBlob(sha256Hash)
 	if os.IsNotExist(err) {
 		http.NotFound(w, r)
 		return
 	}
 
+	fmt.Println("GET", r.URL.Path)
+	fmt.Println("Attempting to get", filename)
+
 	file, err := os.Open(filename)
 	if err != nil {
 		http.Error(w, "Failed to open file", http.StatusInternalServerError)
@@ -552,19 +769,31 @@ func handleGet2(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Length", strconv.FormatInt(fileSize, 10))
 
+	// Use the metadata of the latest upload for anything the query does not specify
+	upload, err := latestUpload(sha256Hash)
+	if err != nil && err != sql.ErrNoRows {
+		logger.Println("Failed to query upload metadata", err)
+	}
+
+	// If no filename is provided, default to the original filename or 'file.bin'
+	if p.Filename == "" {
+		p.Filename = upload.Name
+	}
+	if p.Filename == "" {
+		p.Filename = "file.bin"
+	}
+
+	// Serve the sniffed type, the extension is only used if sniffing found nothing specific
 	if p.ContentType == "" {
-		// Set the content type based on the file extension
-		contentType := mime.TypeByExtension(p.Ext)
-		if contentType == "" {
-			contentType = "application/octet-stream"
+		p.ContentType = sniffedType
+		if isGenericType(p.ContentType) {
+			if extType := typeByExtension(p.Ext); extType != "" {
+				p.ContentType = extType
+			}
 		}
-		w.Header().Set("Content-Type", contentType)
-	} else {
-		w.Header().Set("Content-Type", p.ContentType)
 	}
 
-	// Set the content disposition to attachment with the provided filename
-	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, p.Filename))
+	setContentHeaders(w, p.ContentType, p.Filename, true)
 
 	_, err = io.Copy(w, file)
 	if err != nil {
@@ -574,7 +803,7 @@ func handleGet2(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleStats(w http.ResponseWriter, r *http.Request) {
-	enableCors(&w)
+	enableCors(&w, r, apiCors)
 	if r.Method == "OPTIONS" {
 		return
 	}
@@ -583,21 +812,14 @@ func handleStats(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	files, err := fs.ReadDir(os.DirFS(*dataDir), ".")
+	// Count the files in the database instead of listing the data folder, which is slow for large stores.
+	// Files uploaded before sizes were stored have no size, so the total size is too low until the rehash job has filled it in.
+	var totalFiles, totalSize int64
+	err := db.QueryRow("SELECT COUNT(*), COALESCE(SUM(size), 0) FROM data").Scan(&totalFiles, &totalSize)
 	if err != nil {
-		http.Error(w, "Failed to read directory", http.StatusInternalServerError)
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
 		return
 	}
-
-	totalSize := int64(0)
-	for _, file := range files {
-		info, err := file.Info()
-		if err != nil {
-			http.Error(w, "Failed to get file info", http.StatusInternalServerError)
-			return
-		}
-		totalSize += info.Size()
-	}
 	totalSpace, err := getTotalDiskSpace(*dataDir)
 	if err != nil {
 		http.Error(w, "Failed to get total disk space", http.StatusInternalServerError)
@@ -618,7 +840,7 @@ func handleStats(w http.ResponseWriter, r *http.Request) {
 	response := map[string]interface{}{
 		"uploadingDisabled":  *disableUpload,
 		"shorteningDisabled": *disableShorten,
-		"totalFiles":         len(files),
+		"totalFiles":         totalFiles,
 		"totalSize":          totalSize,
 		"totalSpace":         totalSpace,
 		"availableSpace":     availableSpace,
@@ -633,117 +855,8 @@ func handleStats(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-func handleShorten(w http.ResponseWriter, r *http.Request) {
-	enableCors(&w)
-	var response struct {
-		Success bool   `json:"success"`
-		Error   string `json:"error"`
-		ID      string `json:"id"`
-	}
-	if r.Method == "OPTIONS" {
-		return
-	}
-	if r.Method != http.MethodPost {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
-		return
-	}
-
-	var request struct {
-		URL string `json:"url"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
-	}
-
-	hasher := crc64.New(crc64.MakeTable(crc64.ISO))
-	hasher.Write([]byte(request.URL))
-	id := fmt.Sprintf("%x", hasher.Sum64())
-
-	// Check if the Url is valid
-	if len(request.URL) > 2048 {
-		response.Success = false
-		response.Error = "Url is too long (>2048 characters)"
-		response.ID = ""
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-
-	if !isValidURL(request.URL) {
-		response.Success = false
-		response.Error = "Url is not valid"
-		response.ID = ""
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-
-	// Check if the URL is already in the database
-	var existingID string
-	err := db.QueryRow("SELECT id FROM urls WHERE url = ?", request.URL).Scan(&existingID)
-	if err != nil && err != sql.ErrNoRows {
-		http.Error(w, "Failed to check URL", http.StatusInternalServerError)
-		return
-	}
-
-	if existingID != "" {
-		// URL is already in the database, return the existing ID
-		response.Success = true
-		response.Error = ""
-		response.ID = existingID
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-
-	// Get current unix time
-	uploadTime := time.Now().Unix()
-
-	// URL is not in the database, insert it with hits set to  0
-	_, err = db.Exec("INSERT INTO urls (id, url, hits, uploaded) VALUES (?, ?, 0, ?)", id, request.URL, uploadTime)
-	if err != nil {
-		response.Success = false
-		response.Error = "Failed to insert URL into database: " + err.Error()
-		response.ID = ""
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-
-	response.Error = ""
-	response.Success = true
-	response.ID = id
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-}
-
-func handleU(w http.ResponseWriter, r *http.Request) {
-	enableCors(&w)
-	id := r.URL.Path[len("/u/"):]
-
-	var url string
-	err := db.QueryRow("SELECT url FROM urls WHERE id = ?", id).Scan(&url)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			http.NotFound(w, r)
-		} else {
-			http.Error(w, "Failed to retrieve URL", http.StatusInternalServerError)
-		}
-		return
-	}
-
-	// Increment the hits counter for the URL
-	_, err = db.Exec("UPDATE urls SET hits = hits + 1 WHERE id = ?", id)
-	if err != nil {
-		log.Printf("Failed to increment hits for URL with id %s: %v", id, err)
-	}
-
-	http.Redirect(w, r, url, http.StatusFound)
-}
-
 func handleHealth(w http.ResponseWriter, r *http.Request) {
-	enableCors(&w)
+	enableCors(&w, r, apiCors)
 	if r.Method == "OPTIONS" {
 		return
 	}
@@ -753,7 +866,7 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 }
 
 func handlePing(w http.ResponseWriter, r *http.Request) {
-	enableCors(&w)
+	enableCors(&w, r, apiCors)
 	if r.Method == "OPTIONS" {
 		return
 	}
@@ -762,7 +875,7 @@ func handlePing(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleLoad(w http.ResponseWriter, r *http.Request) {
-	enableCors(&w)
+	enableCors(&w, r, apiCors)
 	if r.Method == "OPTIONS" {
 		return
 	}
@@ -777,44 +890,26 @@ func handleLoad(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-func dbFixer() {
-	logLevelln(0, "Cleaning database")
-
+// dbFixer deletes entries from the database whose file no longer exists.
+// Quarantined files are skipped since they have been moved out of the data folder on purpose.
+func dbFixer(job *Job, dry bool) error {
 	logLevelln(0, "Looking for missing files...")
-	// Query the database to get all IDs
-	rows, err := db.Query("SELECT id FROM data")
-	if err != nil {
-		log.Fatalf("Failed to query database: %v", err)
-	}
-	defer rows.Close()
-
-	// Iterate over the rows
-	for rows.Next() {
-		var id string
-		if err := rows.Scan(&id); err != nil {
-			log.Fatalf("Failed to scan row: %v", err)
-		}
-
-		// Construct the file path
-		filePath := filepath.Join(*dataDir, id)
 
+	return forEachID(job, "data", "id NOT IN (SELECT id FROM quarantine)", func(id string) {
 		// Check if the file exists
-		_, err := os.Stat(filePath)
+		_, err := resolveBlob(id)
 		if os.IsNotExist(err) {
 			// If the file does not exist, delete the entry from the database
-			if !*fixDb_dry {
+			if !dry {
 				_, err := db.Exec("DELETE FROM data WHERE id = ?", id)
 				if err != nil {
 					log.Printf("Failed to delete entry with ID %s: %v", id, err)
+					return
 				}
 			}
 			log.Printf("Deleted entry with ID %s because the file does not exist", id)
 		}
-	}
-
-	if err := rows.Err(); err != nil {
-		log.Fatalf("Error iterating over rows: %v", err)
-	}
+	})
 }
 
 func isValidURL(str string) bool {
@@ -822,70 +917,181 @@ func isValidURL(str string) bool {
 	return err == nil && u.Scheme != "" && u.Host != ""
 }
 
-func resniff() {
-	// Query the database to get all file IDs
-	rows, err := db.Query("SELECT id FROM data")
-	if err != nil {
-		log.Fatalf("Failed to query database: %v", err)
-	}
-	defer rows.Close()
-
-	// Initialize a counter for the number of files processed
-	var fileCount int
-
-	// Get the total number of rows in the database
-	var totalRows int
-	err = db.QueryRow("SELECT COUNT(*) FROM data").Scan(&totalRows)
-	if err != nil {
-		log.Fatalf("Failed to get total row count: %v", err)
-	}
-
-	// Iterate over the rows
-	for rows.Next() {
-		var id string
-		if err := rows.Scan(&id); err != nil {
-			log.Fatalf("Failed to scan row: %v", err)
+func resniff(job *Job, dry bool) error {
+	return forEachID(job, "data", "", func(id string) {
+		// Find the file
+		filePath, err := resolveBlob(id)
+		if err != nil {
+			log.Printf("Failed to find file %s: %v", id, err)
+			return
 		}
 
-		// Construct the file path
-		filePath := filepath.Join(*dataDir, id)
-
 		// Open the file
 		file, err := os.Open(filePath)
 		if err != nil {
 			log.Printf("Failed to open file %s: %v", filePath, err)
-			continue
+			return
 		}
-		defer file.Close()
 
 		// Read the first 1KB of the file
 		buffer := make([]byte, 1024)
 		n, err := file.Read(buffer)
+		file.Close()
 		if err != nil && err != io.EOF {
 			log.Printf("Failed to read file %s: %v", filePath, err)
-			continue
+			return
 		}
 
 		// Sniff the content type
 		contentType := sniff.DetectContentType(buffer[:n])
 
+		if dry {
+			return
+		}
+
 		// Update the database with the new content type
 		_, err = db.Exec("UPDATE data SET type = ? WHERE id = ?", contentType, id)
 		if err != nil {
 			log.Printf("Failed to update content type for file %s: %v", filePath, err)
-			continue
 		}
+	})
+}
+
+// computeHashes computes the sha256, sha1, md5 and crc32 hashes of the data and sniffs its content type.
+// The ahash and dhash are also computed if the data is an image.
+func computeHashes(data []byte) (map[string]string, string) {
+	// Create a wait group to wait for all hash computations to finish
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	hashes := make(map[string]string)
+
+	logLevelln(1, "Computing hashes")
+
+	// Define a function to compute a hash and store it in the map
+	computeHash := func(hashFunc crypto.Hash, hashKey string) {
+		logLevelln(1, "Computing "+hashKey)
+		defer wg.Done()
+		hasher := hashFunc.New()
+		hasher.Write(data)
+		hash := hex.EncodeToString(hasher.Sum(nil))
+		mu.Lock()
+		hashes[hashKey] = hash
+		mu.Unlock()
+		logLevelln(1, "Computed "+hashKey)
+	}
+
+	// Compute SHA256, SHA1, MD5, and CRC32 hashes concurrently
+	wg.Add(3)
+	go computeHash(crypto.SHA256, "sha256")
+	go computeHash(crypto.SHA1, "sha1")
+	go computeHash(crypto.MD5, "md5")
+	wg.Wait()
+
+	// Compute CRC32 hash
+	crc32Hasher := crc32.NewIEEE()
+	crc32Hasher.Write(data)
+	hashes["crc32"] = fmt.Sprintf("%x", crc32Hasher.Sum32())
+
+	// Get the filetype based on magic number
+	logLevelln(1, "Getting filetype")
+	contentType := sniff.DetectContentType(data)
+
+	if isHashableImage(contentType) {
+		logLevelln(1, "Detected image, computing Ahash and Dhash")
+		aHash, dHash, err := perceptualHashes(bytes.NewReader(data))
+		if err != nil {
+			logger.Println("Failed to compute perceptual hashes", err)
+		}
+
+		hashes["dhash"] = dHash
+		hashes["ahash"] = aHash
+
+	}
+
+	return hashes, contentType
+}
+
+// copyHashes copies r to w while computing the sha256, sha1, md5 and crc32 hashes of the data, and
+// sniffs its content type from the first 1KB. Unlike computeHashes it does not hold the data in
+// memory, so the perceptual hashes of images are left to the caller.
+func copyHashes(w io.Writer, r io.Reader) (map[string]string, string, int64, error) {
+	sha256Hasher, sha1Hasher, md5Hasher, crc32Hasher := crypto.SHA256.New(), crypto.SHA1.New(), crypto.MD5.New(), crc32.NewIEEE()
+	head := &headBuffer{max: 1024}
+	size, err := io.Copy(io.MultiWriter(w, sha256Hasher, sha1Hasher, md5Hasher, crc32Hasher, head), r)
+	if err != nil {
+		return nil, "", size, err
+	}
+	hashes := map[string]string{
+		"sha256": hex.EncodeToString(sha256Hasher.Sum(nil)),
+		"sha1":   hex.EncodeToString(sha1Hasher.Sum(nil)),
+		"md5":    hex.EncodeToString(md5Hasher.Sum(nil)),
+		"crc32":  fmt.Sprintf("%x", crc32Hasher.Sum32()),
+	}
+	return hashes, sniff.DetectContentType(head.Bytes()), size, nil
+}
 
-		// Increment the file counter
-		fileCount++
+// headBuffer keeps the first max bytes written to it and discards the rest.
+type headBuffer struct {
+	bytes.Buffer
+	max int
+}
 
-		// Print the progress
-		fmt.Printf("Processed file %d/%d\n", fileCount, totalRows)
+func (b *headBuffer) Write(p []byte) (int, error) {
+	if n := b.max - b.Len(); n > 0 {
+		b.Buffer.Write(p[:min(n, len(p))])
+	}
+	return len(p), nil
+}
+
+// insertData writes the hashes and upload time of a stored file to the "data" table, and adds the file
+// to the changes feed.
+func insertData(hashes map[string]string, contentType string, size, uploaded int64) error {
+	now := time.Now().Unix()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
 
-	if err := rows.Err(); err != nil {
-		log.Fatalf("Error iterating over rows: %v", err)
+	_, err = tx.Exec(`INSERT INTO data (id, sha256, sha1, md5, crc32, ahash, dhash, type, size, uploaded) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		hashes["sha256"], hashes["sha256"], hashes["sha1"], hashes["md5"], hashes["crc32"], hashes["ahash"], hashes["dhash"], contentType, size, uploaded)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO changes (data_id, changed) VALUES (?, ?)", hashes["sha256"], now); err != nil {
+		return err
 	}
+	return tx.Commit()
+}
+
+// isHashableImage reports whether Ahash and Dhash can be computed for files of the given content type.
+func isHashableImage(contentType string) bool {
+	return contentType == "image/jpeg" || contentType == "image/png" || contentType == "image/gif"
+}
+
+// perceptualHashes decodes an image and returns its hex encoded Ahash and Dhash.
+func perceptualHashes(r io.Reader) (string, string, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Choose the hash length
+	hashLen := 32
+
+	// Hash the image with Ahash
+	ahashBytes, err := hash.Ahash(img, hashLen)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Hash the image with Dhash
+	dhashBytes, err := hash.Dhash(img, hashLen)
+	if err != nil {
+		return "", "", err
+	}
+
+	return hex.EncodeToString(ahashBytes), hex.EncodeToString(dhashBytes), nil
 }
 
 func logLevelln(l int, s string) {
@@ -894,12 +1100,6 @@ func logLevelln(l int, s string) {
 	}
 }
 
-func enableCors(w *http.ResponseWriter) {
-	(*w).Header().Set("Access-Control-Allow-Origin", "*")
-	(*w).Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-	(*w).Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
-}
-
 func onStart() {
 	// Check if data directory exists
 	_, err := os.Stat(*dataDir)
@@ -954,6 +1154,240 @@ func initDB() {
 	if err != nil {
 		log.Fatalf("Failed to create table: %v", err)
 	}
+	addColumn("data", "size", "INTEGER")
+	// Create blocklist table
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS blocklist (
+		hash VARCHAR(255) PRIMARY KEY,
+		algo VARCHAR(16) NOT NULL,
+		distance INTEGER NOT NULL,
+		reason TEXT,
+		source TEXT,
+		added INTEGER NOT NULL
+	)`)
+	if err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
+	// Create jobs table
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS jobs (
+		id VARCHAR(255) PRIMARY KEY,
+		name VARCHAR(64) NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		dry INTEGER NOT NULL,
+		done INTEGER NOT NULL,
+		total INTEGER NOT NULL,
+		checkpoint VARCHAR(255) NOT NULL,
+		error TEXT,
+		started INTEGER NOT NULL,
+		finished INTEGER NOT NULL
+	)`)
+	if err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
+	// Create scrub_issues table, the problems found by the scrub job so far
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS scrub_issues (
+		job_id VARCHAR(255) NOT NULL,
+		id VARCHAR(255) NOT NULL,
+		problem VARCHAR(16) NOT NULL,
+		action TEXT
+	)`)
+	if err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
+	addIndex("scrub_issues_job_id", "scrub_issues", "job_id")
+	// Create uploads table, one row per upload event of a file in the data table
+	_, err = db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS uploads (
+		id %s,
+		data_id VARCHAR(255) NOT NULL,
+		name TEXT,
+		size INTEGER,
+		declared_type TEXT,
+		type TEXT,
+		ip_hash VARCHAR(64),
+		owner VARCHAR(255),
+		uploaded INTEGER NOT NULL
+	)`, autoIncrement()))
+	if err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
+	addIndex("uploads_data_id", "uploads", "data_id")
+	// Create meta table for settings the server stores itself
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS meta (
+		name VARCHAR(255) PRIMARY KEY,
+		value TEXT
+	)`)
+	if err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
+	// Create quarantine table
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS quarantine (
+		id VARCHAR(255) PRIMARY KEY,
+		reason TEXT,
+		quarantined INTEGER NOT NULL
+	)`)
+	if err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
+	// Create pastes table
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS pastes (
+		id VARCHAR(32) PRIMARY KEY,
+		data_id VARCHAR(255) NOT NULL,
+		lang VARCHAR(32),
+		burn INTEGER NOT NULL DEFAULT 0,
+		stored INTEGER NOT NULL DEFAULT 0,
+		expires INTEGER NOT NULL DEFAULT 0,
+		created INTEGER NOT NULL
+	)`)
+	if err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
+	addIndex("pastes_data_id", "pastes", "data_id")
+	addIndex("pastes_expires", "pastes", "expires")
+	// Create albums tables
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS albums (
+		id VARCHAR(32) PRIMARY KEY,
+		title TEXT,
+		created INTEGER NOT NULL
+	)`)
+	if err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS album_items (
+		album_id VARCHAR(32) NOT NULL,
+		position INTEGER NOT NULL,
+		data_id VARCHAR(255) NOT NULL,
+		name TEXT,
+		PRIMARY KEY (album_id, position)
+	)`)
+	if err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
+	addIndex("album_items_data_id", "album_items", "data_id")
+	addColumn("urls", "custom", "INTEGER NOT NULL DEFAULT 0")
+	addColumn("urls", "expires", "INTEGER NOT NULL DEFAULT 0")
+	addColumn("urls", "max_hits", "INTEGER NOT NULL DEFAULT 0")
+	addColumn("urls", "disabled", "INTEGER NOT NULL DEFAULT 0")
+	addColumn("urls", "token", "VARCHAR(64)")
+	migrateShortLinkIDs()
+	migrateBlocklistDistance()
+	// Create clicks table, one row per redirect of a short link
+	_, err = db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS clicks (
+		id %s,
+		url_id VARCHAR(255) NOT NULL,
+		clicked INTEGER NOT NULL,
+		referrer VARCHAR(255),
+		agent VARCHAR(32),
+		ip_hash VARCHAR(64)
+	)`, autoIncrement()))
+	if err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
+	addIndex("clicks_url_id", "clicks", "url_id, clicked")
+	addIndex("clicks_clicked", "clicks", "clicked")
+	// Create fetches table, one row per download started with /fetch
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS fetches (
+		id VARCHAR(32) PRIMARY KEY,
+		url TEXT NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		error TEXT,
+		name TEXT,
+		sha256 VARCHAR(64),
+		type VARCHAR(255),
+		size INTEGER,
+		owner VARCHAR(255),
+		ip_hash VARCHAR(64),
+		strip INTEGER NOT NULL DEFAULT 0,
+		created INTEGER NOT NULL,
+		finished INTEGER NOT NULL DEFAULT 0
+	)`)
+	if err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
+	addIndex("fetches_status", "fetches", "status")
+	// Create changes table, the feed of added files that peers replicate from
+	_, err = db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS changes (
+		seq %s,
+		data_id VARCHAR(255) NOT NULL,
+		changed INTEGER NOT NULL
+	)`, autoIncrement()))
+	if err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
+	backfillChanges()
+	// Create replication table, the last change pulled from every peer
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS replication (
+		peer VARCHAR(255) PRIMARY KEY,
+		seq INTEGER NOT NULL,
+		updated INTEGER NOT NULL
+	)`)
+	if err != nil {
+		log.Fatalf("Failed to create table: %v", err)
+	}
+}
+
+// autoIncrement returns the definition of an auto incrementing primary key for the database type.
+func autoIncrement() string {
+	if *dbType == "mysql" {
+		return "INTEGER PRIMARY KEY AUTO_INCREMENT"
+	}
+	return "INTEGER PRIMARY KEY AUTOINCREMENT"
+}
+
+// addIndex creates an index if it does not exist yet. mysql does not support CREATE INDEX IF NOT EXISTS,
+// so the index is looked up first.
+func addIndex(name, table, columns string) {
+	if *dbType == "mysql" {
+		var count int
+		err := db.QueryRow("SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = ? AND index_name = ?", table, name).Scan(&count)
+		if err != nil {
+			log.Fatalf("Failed to look up index %s: %v", name, err)
+		}
+		if count > 0 {
+			return
+		}
+		_, err = db.Exec(fmt.Sprintf("CREATE INDEX %s ON %s (%s)", name, table, columns))
+		if err != nil {
+			log.Fatalf("Failed to create index %s: %v", name, err)
+		}
+		return
+	}
+
+	_, err := db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s)", name, table, columns))
+	if err != nil {
+		log.Fatalf("Failed to create index %s: %v", name, err)
+	}
+}
+
+// getMeta returns a value from the meta table, or an empty string if it is not set.
+func getMeta(name string) (string, error) {
+	var value string
+	err := db.QueryRow("SELECT value FROM meta WHERE name = ?", name).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+// setMeta stores a value in the meta table.
+func setMeta(name, value string) error {
+	if _, err := db.Exec("DELETE FROM meta WHERE name = ?", name); err != nil {
+		return err
+	}
+	_, err := db.Exec("INSERT INTO meta (name, value) VALUES (?, ?)", name, value)
+	return err
+}
+
+// addColumn adds a column to an existing table if it does not have it yet.
+// Neither sqlite nor mysql support ADD COLUMN IF NOT EXISTS, so the column is probed with a SELECT first.
+func addColumn(table, column, definition string) {
+	rows, err := db.Query(fmt.Sprintf("SELECT %s FROM %s LIMIT 1", column, table))
+	if err == nil {
+		rows.Close()
+		return
+	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		log.Fatalf("Failed to add column %s to %s: %v", column, table, err)
+	}
 }
 
 func getCores() int {
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	logger = log.New(io.Discard, "", 0)
+	os.Exit(m.Run())
+}
+
+// setupTestDB points the database and the data folder at a new sqlite database and folder that are
+// removed when the test ends.
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	oldDB, oldDir := db, *dataDir
+	*dataDir = dir
+
+	var err error
+	db, err = sql.Open("sqlite3", "file:"+filepath.Join(dir, "yapc.db")+"?mode=rwc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	initDB()
+	initIPSalt()
+
+	t.Cleanup(func() {
+		db.Close()
+		db, *dataDir = oldDB, oldDir
+	})
+}
+
+// setFlag changes a flag for the rest of a test.
+func setFlag[T any](t *testing.T, flag *T, value T) {
+	t.Helper()
+	old := *flag
+	*flag = value
+	t.Cleanup(func() { *flag = old })
+}
+
+// storeFile uploads a file to /store and returns the response.
+func storeFile(t *testing.T, query string, data []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	mw.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/store?"+query, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	handleStore(w, r)
+	return w
+}
+
+func TestStoreStripMaxSize(t *testing.T) {
+	setupTestDB(t)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 64, 64))); err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, stripMaxSize, int64(buf.Len()-1))
+
+	if w := storeFile(t, "strip=1", buf.Bytes()); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("stripping a large image = %d %s, want 413", w.Code, w.Body.String())
+	}
+	// Only images are held to the limit, other files are not stripped
+	if w := storeFile(t, "strip=1", []byte(strings.Repeat("text ", buf.Len()))); w.Code != http.StatusCreated {
+		t.Errorf("storing a large text file = %d %s, want 201", w.Code, w.Body.String())
+	}
+	if w := storeFile(t, "", buf.Bytes()); w.Code != http.StatusCreated {
+		t.Errorf("storing a large image without stripping = %d %s, want 201", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hexahigh/yapc/backend/lib/highlight"
+)
+
+var errPasteExpired = errors.New("paste has expired")
+
+// parseExpiry parses a paste expiry given in seconds or as a duration like 1h30m.
+func parseExpiry(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// getPaste returns a paste. Expired pastes are deleted and errPasteExpired is returned.
+func getPaste(id string) (Paste, error) {
+	var p Paste
+	var lang sql.NullString
+	var burn, stored int
+	err := db.QueryRow("SELECT id, data_id, lang, burn, stored, expires, created FROM pastes WHERE id = ?", id).
+		Scan(&p.ID, &p.DataID, &lang, &burn, &stored, &p.Expires, &p.Created)
+	if err != nil {
+		return p, err
+	}
+	p.Lang = lang.String
+	p.Burn = burn == 1
+	p.Stored = stored == 1
+
+	if p.Expires > 0 && time.Now().Unix() > p.Expires {
+		if err := deletePaste(p); err != nil {
+			logger.Println("Failed to delete expired paste", p.ID, err)
+		}
+		return p, errPasteExpired
+	}
+	return p, nil
+}
+
+// deletePaste deletes a paste. The file is deleted as well if the paste stored it and nothing
+// else uses it.
+func deletePaste(p Paste) error {
+	if _, err := db.Exec("DELETE FROM pastes WHERE id = ?", p.ID); err != nil {
+		return err
+	}
+	return releasePasteData(p)
+}
+
+// releasePasteData deletes the file of a deleted paste if the paste stored it, and no other paste,
+// upload or album uses it.
+func releasePasteData(p Paste) error {
+	if !p.Stored {
+		return nil
+	}
+
+	for _, table := range []string{"pastes", "uploads", "album_items"} {
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE data_id = ?", p.DataID).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			return nil
+		}
+	}
+	return deleteUpload(p.DataID)
+}
+
+// expirePastes deletes expired pastes every few minutes.
+func expirePastes() {
+	for {
+		rows, err := db.Query("SELECT id FROM pastes WHERE expires > 0 AND expires < ?", time.Now().Unix())
+		if err != nil {
+			logger.Println("Failed to query expired pastes", err)
+		} else {
+			var ids []string
+			for rows.Next() {
+				var id string
+				if err := rows.Scan(&id); err == nil {
+					ids = append(ids, id)
+				}
+			}
+			rows.Close()
+
+			// getPaste deletes the pastes it finds expired
+			for _, id := range ids {
+				getPaste(id)
+			}
+			if len(ids) > 0 {
+				logLevelln(1, fmt.Sprintf("Deleted %d expired pastes", len(ids)))
+			}
+		}
+
+		time.Sleep(5 * time.Minute)
+	}
+}
+
+func handlePaste(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&uploadCount, 1)
+	defer atomic.AddInt64(&uploadCount, -1)
+
+	type PasteResponse struct {
+		ID      string `json:"id"`
+		URL     string `json:"url"`
+		Raw     string `json:"raw"`
+		SHA256  string `json:"sha256"`
+		Lang    string `json:"lang"`
+		Burn    bool   `json:"burn"`
+		Expires int64  `json:"expires"`
+	}
+
+	enableCors(&w, r, apiCors)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := r.URL.Query()
+	lang := strings.ToLower(params.Get("lang"))
+	if lang != "" {
+		l, ok := highlight.Lookup(lang)
+		if !ok {
+			http.Error(w, "Unknown language, use one of "+strings.Join(highlight.Names(), ", "), http.StatusBadRequest)
+			return
+		}
+		lang = l.Name
+	}
+
+	expiry, err := parseExpiry(params.Get("expires"))
+	if err != nil || expiry < 0 {
+		http.Error(w, "Invalid expiry", http.StatusBadRequest)
+		return
+	}
+	var expires int64
+	if expiry > 0 {
+		expires = time.Now().Add(expiry).Unix()
+	}
+	burn := parseBool(params.Get("burn"))
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, *pasteMaxSize))
+	if err != nil {
+		http.Error(w, "Paste too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if len(data) == 0 {
+		http.Error(w, "Empty paste", http.StatusBadRequest)
+		return
+	}
+	if !utf8.Valid(data) {
+		http.Error(w, "Pastes must be UTF-8 text", http.StatusBadRequest)
+		return
+	}
+
+	hashes, _, created, err := storeBlob(data)
+	if err == errBlocked {
+		http.Error(w, "This file has been blocked", http.StatusUnavailableForLegalReasons)
+		return
+	}
+	if err != nil {
+		logger.Println("Failed to store paste", err)
+		http.Error(w, "Failed to store paste", http.StatusInternalServerError)
+		return
+	}
+
+	id := randomBase62(10)
+	_, err = db.Exec("INSERT INTO pastes (id, data_id, lang, burn, stored, expires, created) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		id, hashes["sha256"], lang, boolInt(burn), boolInt(created), expires, time.Now().Unix())
+	if err != nil {
+		http.Error(w, "Failed to store paste", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(PasteResponse{
+		ID:      id,
+		URL:     baseURL(r) + "/p/" + id,
+		Raw:     baseURL(r) + "/raw/" + id,
+		SHA256:  hashes["sha256"],
+		Lang:    lang,
+		Burn:    burn,
+		Expires: expires,
+	})
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// readPaste looks up a paste and reads its text. Burn after reading pastes are deleted, and only
+// the first request to claim one gets its text.
+func readPaste(w http.ResponseWriter, r *http.Request, id string) (Paste, []byte, bool) {
+	p, err := getPaste(id)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return p, nil, false
+	}
+	if err == errPasteExpired {
+		http.Error(w, "This paste has expired", http.StatusGone)
+		return p, nil, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		return p, nil, false
+	}
+
+	blocked, _, err := blockedByID(p.DataID)
+	if err != nil {
+		http.Error(w, "Failed to check blocklist", http.StatusInternalServerError)
+		return p, nil, false
+	}
+	if blocked {
+		http.Error(w, "This file has been blocked", http.StatusUnavailableForLegalReasons)
+		return p, nil, false
+	}
+
+	path, err := resolveBlob(p.DataID)
+	if err != nil {
+		http.NotFound(w, r)
+		return p, nil, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		http.Error(w, "Failed to open file", http.StatusInternalServerError)
+		return p, nil, false
+	}
+
+	if p.Burn {
+		res, err := db.Exec("DELETE FROM pastes WHERE id = ?", p.ID)
+		if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			return p, nil, false
+		}
+		if n, _ := res.RowsAffected(); n != 1 {
+			// Someone else read it first
+			http.NotFound(w, r)
+			return p, nil, false
+		}
+		if err := releasePasteData(p); err != nil {
+			logger.Println("Failed to delete burned paste", p.ID, err)
+		}
+		w.Header().Set("Cache-Control", "no-store")
+	}
+
+	return p, data, true
+}
+
+var pasteTemplate = template.Must(template.New("paste").Funcs(template.FuncMap{
+	"inc": func(i int) int { return i + 1 },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Paste {{.ID}}</title>
+<style>
+body { margin: 0; background: #1e1e1e; color: #d4d4d4; font: 14px/1.5 ui-monospace, Menlo, Consolas, monospace; }
+header { padding: 8px 16px; background: #252526; border-bottom: 1px solid #333; }
+header a { color: #9cdcfe; margin-right: 16px; }
+table { border-collapse: collapse; width: 100%; }
+td { padding: 0 12px; vertical-align: top; }
+td.ln { text-align: right; user-select: none; width: 1%; }
+td.ln a { color: #6e7681; text-decoration: none; }
+td.code { white-space: pre-wrap; word-break: break-all; }
+tr:target { background: #3a3d41; }
+.c { color: #6a9955; } .s { color: #ce9178; } .n { color: #b5cea8; } .k { color: #569cd6; }
+.ga { color: #89d185; } .gd { color: #f48771; } .gh { color: #c586c0; }
+p { padding: 16px; }
+</style>
+</head>
+<body>
+{{if .Confirm}}
+<p>This paste will be deleted after it has been viewed once.</p>
+<p><a href="{{.ViewLink}}">View it now</a></p>
+{{else}}
+<header>
+{{if .RawLink}}<a href="{{.RawLink}}">Raw</a>{{end}}{{if .Lang}}<span>{{.Lang}}</span>{{end}}{{if .Burn}}<span> This paste has been deleted and can not be viewed again.</span>{{end}}
+</header>
+<table>
+{{range $i, $line := .Lines}}<tr id="L{{inc $i}}"><td class="ln"><a href="#L{{inc $i}}">{{inc $i}}</a></td><td class="code">{{$line}}</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
+
+func handlePasteView(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w, r, contentCors)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if !requireSignature(w, r) {
+		return
+	}
+
+	id := r.URL.Path[len("/p/"):]
+
+	type view struct {
+		ID       string
+		Lang     string
+		Burn     bool
+		Confirm  bool
+		ViewLink string
+		RawLink  string
+		Lines    []template.HTML
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	// Link previews would burn the paste, so ask first
+	p, err := getPaste(id)
+	if err == nil && p.Burn && !parseBool(r.URL.Query().Get("confirm")) {
+		w.Header().Set("Cache-Control", "no-store")
+		pasteTemplate.Execute(w, view{ID: id, Confirm: true, ViewLink: signedLink(r, "/p/"+id, url.Values{"confirm": {"1"}})})
+		return
+	}
+
+	p, data, ok := readPaste(w, r, id)
+	if !ok {
+		return
+	}
+
+	v := view{ID: p.ID, Lang: p.Lang, Burn: p.Burn}
+	// A burned paste is already gone, so it has no raw link
+	if !p.Burn {
+		v.RawLink = signedLink(r, "/raw/"+p.ID, url.Values{})
+	}
+	text := strings.TrimSuffix(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	for _, line := range highlight.Highlight(text, p.Lang) {
+		// The highlighter escapes the text itself
+		v.Lines = append(v.Lines, template.HTML(line))
+	}
+	if err := pasteTemplate.Execute(w, v); err != nil {
+		logger.Println("Failed to render paste", err)
+	}
+}
+
+func handlePasteRaw(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w, r, contentCors)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if !requireSignature(w, r) {
+		return
+	}
+
+	id := r.URL.Path[len("/raw/"):]
+	_, data, ok := readPaste(w, r, id)
+	if !ok {
+		return
+	}
+
+	setContentHeaders(w, "text/plain; charset=utf-8", "", false)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
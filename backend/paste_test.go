@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createPaste stores a paste through /paste and returns its id.
+func createPaste(t *testing.T, text, query string) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handlePaste(w, httptest.NewRequest(http.MethodPost, "/paste?"+query, strings.NewReader(text)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST /paste = %d %s", w.Code, w.Body.String())
+	}
+	var p struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	return p.ID
+}
+
+func dataExists(t *testing.T, id string) bool {
+	t.Helper()
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM data WHERE id = ?", id).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count > 0
+}
+
+func TestDeletePasteKeepsFilesInUse(t *testing.T) {
+	setupTestDB(t)
+
+	id := createPaste(t, "in an album", "")
+	p, err := getPaste(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO album_items (album_id, position, data_id, name) VALUES ('a', 0, ?, 'x.txt')", p.DataID); err != nil {
+		t.Fatal(err)
+	}
+	if err := deletePaste(p); err != nil {
+		t.Fatal(err)
+	}
+	if !dataExists(t, p.DataID) {
+		t.Fatal("deleting a paste deleted a file that is in an album")
+	}
+
+	// Once nothing uses it the file goes with the last paste
+	id = createPaste(t, "only a paste", "")
+	if p, err = getPaste(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := deletePaste(p); err != nil {
+		t.Fatal(err)
+	}
+	if dataExists(t, p.DataID) {
+		t.Error("deleting the only paste of a file kept the file")
+	}
+}
+
+// pasteLinks matches the links on a paste page.
+var pasteLinks = regexp.MustCompile(`href="([^"#]+)"`)
+
+func get(handler http.HandlerFunc, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w
+}
+
+func TestPasteSignature(t *testing.T) {
+	setupTestDB(t)
+	setFlag(t, signKey, "secret")
+	setFlag(t, signRequire, true)
+
+	id := createPaste(t, "package main", "lang=go")
+	if w := get(handlePasteView, "/p/"+id); w.Code != http.StatusForbidden {
+		t.Errorf("unsigned /p/ = %d, want 403", w.Code)
+	}
+	if w := get(handlePasteRaw, "/raw/"+id); w.Code != http.StatusForbidden {
+		t.Errorf("unsigned /raw/ = %d, want 403", w.Code)
+	}
+
+	expires := time.Now().Add(time.Hour)
+	w := get(handlePasteView, signURL("/p/"+id, url.Values{}, expires))
+	if w.Code != http.StatusOK {
+		t.Fatalf("signed /p/ = %d %s", w.Code, w.Body.String())
+	}
+	// The raw link on a signed page is signed as well
+	m := pasteLinks.FindStringSubmatch(w.Body.String())
+	if m == nil {
+		t.Fatal("paste page has no raw link")
+	}
+	raw := html.UnescapeString(m[1])
+	if w := get(handlePasteRaw, raw); w.Code != http.StatusOK || w.Body.String() != "package main" {
+		t.Errorf("raw link %s = %d %q", raw, w.Code, w.Body.String())
+	}
+}
+
+func TestBurnPasteSignature(t *testing.T) {
+	setupTestDB(t)
+	setFlag(t, signKey, "secret")
+	setFlag(t, signRequire, true)
+
+	id := createPaste(t, "read once", "burn=1")
+	w := get(handlePasteView, signURL("/p/"+id, url.Values{}, time.Now().Add(time.Hour)))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "View it now") {
+		t.Fatalf("signed /p/ of a burn paste = %d %s", w.Code, w.Body.String())
+	}
+	m := pasteLinks.FindStringSubmatch(w.Body.String())
+	if m == nil {
+		t.Fatal("confirm page has no link")
+	}
+	view := html.UnescapeString(m[1])
+	w = get(handlePasteView, view)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "read once") {
+		t.Errorf("confirm link %s = %d %s", view, w.Code, w.Body.String())
+	}
+	// The paste is gone once it is shown, so there is no raw link to follow
+	if strings.Contains(w.Body.String(), "/raw/") {
+		t.Error("burned paste page has a raw link")
+	}
+	if w := get(handlePasteView, view); w.Code != http.StatusNotFound {
+		t.Errorf("second view of a burn paste = %d, want 404", w.Code)
+	}
+}
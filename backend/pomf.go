@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// PomfFile is a file in the response of /upload.php, in the format of pomf.
+type PomfFile struct {
+	Hash string `json:"hash"`
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	Size int64  `json:"size"`
+}
+
+// PomfResponse is the response of /upload.php.
+type PomfResponse struct {
+	Success     bool       `json:"success"`
+	Files       []PomfFile `json:"files,omitempty"`
+	ErrorCode   int        `json:"errorcode,omitempty"`
+	Description string     `json:"description,omitempty"`
+}
+
+// pomfError responds with an error in the format of pomf, which uses HTTP status codes as error codes.
+func pomfError(w http.ResponseWriter, r *http.Request, code int, description string) {
+	if r.URL.Query().Get("output") == "text" {
+		http.Error(w, description, code)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(PomfResponse{Success: false, ErrorCode: code, Description: description})
+}
+
+// handleUploadPHP is a pomf compatible upload endpoint, so existing pomf clients and scripts can
+// upload to yapc. Files are uploaded as files[] and stored like uploads to /store.
+func handleUploadPHP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&uploadCount, 1)
+	defer atomic.AddInt64(&uploadCount, -1)
+
+	enableCors(&w, r, apiCors)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if r.Method != http.MethodPost {
+		pomfError(w, r, http.StatusMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, *maxFileSize)
+
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			pomfError(w, r, http.StatusRequestEntityTooLarge, "File too large")
+		} else {
+			pomfError(w, r, http.StatusBadRequest, "No input file(s)")
+		}
+		return
+	}
+
+	headers := r.MultipartForm.File["files[]"]
+	if len(headers) == 0 {
+		pomfError(w, r, http.StatusBadRequest, "No input file(s)")
+		return
+	}
+
+	response := PomfResponse{Success: true}
+	for _, header := range headers {
+		stored, _, err := storeUpload(r, header)
+		switch err {
+		case nil:
+		case errBlocked:
+			pomfError(w, r, http.StatusUnavailableForLegalReasons, fmt.Sprintf("File %s has been blocked", cleanFilename(header.Filename)))
+			return
+		case errStrip:
+			pomfError(w, r, http.StatusUnprocessableEntity, fmt.Sprintf("Failed to strip metadata from %s", cleanFilename(header.Filename)))
+			return
+		case errStripTooLarge:
+			pomfError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("File %s is too large to strip metadata from", cleanFilename(header.Filename)))
+			return
+		default:
+			logger.Println("Failed to store file", err)
+			pomfError(w, r, http.StatusInternalServerError, "Failed to store file")
+			return
+		}
+
+		response.Files = append(response.Files, PomfFile{
+			Hash: stored.SHA1,
+			Name: cleanFilename(header.Filename),
+			URL:  baseURL(r) + "/get/" + stored.SHA256,
+			Size: fileSize(stored.SHA256),
+		})
+	}
+
+	if r.URL.Query().Get("output") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, file := range response.Files {
+			fmt.Fprintln(w, file.URL)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(response)
+}
+
+// fileSize returns the stored size of a file, or 0 if it is unknown.
+func fileSize(id string) int64 {
+	var size int64
+	db.QueryRow("SELECT COALESCE(size, 0) FROM data WHERE id = ?", id).Scan(&size)
+	return size
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hexahigh/yapc/backend/lib/qr"
+)
+
+// qrMaxAge is how long QR codes may be cached.
+const qrMaxAge = 24 * time.Hour
+
+// qrTarget returns the link a QR code for an id should point to, and whether it is a file. Short
+// links are looked up first, since a custom slug can look like a hash. With kind set to url or file
+// only that kind is looked up.
+func qrTarget(r *http.Request, id, kind string) (string, bool, error) {
+	if kind == "" || kind == "url" {
+		var exists int
+		if err := db.QueryRow("SELECT COUNT(*) FROM urls WHERE id = ?", id).Scan(&exists); err != nil {
+			return "", false, err
+		}
+		if exists > 0 {
+			return baseURL(r) + "/u/" + id, false, nil
+		}
+	}
+	if kind == "" || kind == "file" {
+		sha256, _, err := resolveHash(id)
+		if err == nil {
+			return baseURL(r) + "/get/" + sha256, true, nil
+		}
+		if err != sql.ErrNoRows {
+			return "", false, err
+		}
+	}
+	return "", false, sql.ErrNoRows
+}
+
+// handleQR renders a QR code linking to a short link or a file, like /qr/{id}.
+func handleQR(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w, r, apiCors)
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	params := r.URL.Query()
+	id := strings.TrimPrefix(r.URL.Path, "/qr/")
+	kind := params.Get("type")
+	if kind != "" && kind != "url" && kind != "file" {
+		http.Error(w, "Invalid type, use url or file", http.StatusBadRequest)
+		return
+	}
+
+	format := params.Get("format")
+	if format == "" {
+		format = "png"
+	}
+	if format != "png" && format != "svg" {
+		http.Error(w, "Invalid format, use png or svg", http.StatusBadRequest)
+		return
+	}
+
+	level := qr.M
+	if v := params.Get("level"); v != "" {
+		var ok bool
+		if level, ok = qr.ParseLevel(v); !ok {
+			http.Error(w, "Invalid level, use L, M, Q or H", http.StatusBadRequest)
+			return
+		}
+	}
+
+	size := 256
+	if v := params.Get("size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 32 || n > 4096 {
+			http.Error(w, "Invalid size, use 32 to 4096 pixels", http.StatusBadRequest)
+			return
+		}
+		size = n
+	}
+
+	// The specification asks for a quiet zone of 4 modules, labels with their own border can use less
+	margin := 4
+	if v := params.Get("margin"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 16 {
+			http.Error(w, "Invalid margin, use 0 to 16 modules", http.StatusBadRequest)
+			return
+		}
+		margin = n
+	}
+
+	target, file, err := qrTarget(r, id, kind)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		return
+	}
+	if file && *signRequire {
+		http.Error(w, "Files on this server need signed links, which expire", http.StatusForbidden)
+		return
+	}
+
+	code, err := qr.Encode([]byte(target), level)
+	if err != nil {
+		http.Error(w, "Failed to encode QR code", http.StatusInternalServerError)
+		return
+	}
+
+	// With signing on, the file a QR code links to is not meant to be public, so only the client may keep it
+	cache := "public, max-age=86400"
+	if file {
+		cache = cacheControl(r, qrMaxAge)
+	}
+	w.Header().Set("Cache-Control", cache)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if format == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		code.WriteSVG(w, size, margin)
+		return
+	}
+
+	// Whole pixels per module keep the code sharp, so the image can be a little smaller than asked for
+	scale := size / (code.Size + 2*margin)
+	if scale < 1 {
+		scale = 1
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, code.Image(scale, margin)); err != nil {
+		http.Error(w, "Failed to encode QR code", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestQRCacheControl(t *testing.T) {
+	setupTestDB(t)
+	id := storeTestImage(t)
+	if _, err := db.Exec("INSERT INTO urls (id, url, hits, uploaded) VALUES ('docs', 'https://example.com', 0, 0)"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key, target, want string
+	}{
+		{"", "/qr/docs", "public, max-age=86400"},
+		{"", "/qr/" + id, "public, max-age=86400"},
+		{"secret", "/qr/docs", "public, max-age=86400"},
+		// Files can only be found through signed links, so their codes are not kept by shared caches
+		{"secret", "/qr/" + id, "private, max-age=86400"},
+	}
+	for _, tt := range tests {
+		setFlag(t, signKey, tt.key)
+		w := get(handleQR, tt.target)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s = %d %s", tt.target, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("Cache-Control"); got != tt.want {
+			t.Errorf("%s with key %q: Cache-Control = %q, want %q", tt.target, tt.key, got, tt.want)
+		}
+	}
+}
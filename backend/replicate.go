@@ -0,0 +1,443 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Change is an entry of the changes feed, a file that was added to the instance. Seq increases with
+// every added file, so a follower only has to remember the last one it has seen.
+type Change struct {
+	Seq      int64  `json:"seq"`
+	SHA256   string `json:"sha256"`
+	SHA1     string `json:"sha1"`
+	MD5      string `json:"md5"`
+	CRC32    string `json:"crc32"`
+	AHash    string `json:"ahash,omitempty"`
+	DHash    string `json:"dhash,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Size     int64  `json:"size"`
+	Uploaded int64  `json:"uploaded"`
+}
+
+const (
+	// changesBatch is the number of changes a follower asks for at once.
+	changesBatch = 500
+	// changesSettle is how old a change has to be before it is in the feed. Sequence numbers are
+	// taken before the change is committed, so a newer change can be visible before an older one.
+	// Holding recent changes back keeps a follower from moving its checkpoint past one it has not seen.
+	changesSettle = 10 * time.Second
+)
+
+var replicaClient = &http.Client{Timeout: 10 * time.Minute}
+
+// errSkipChange is returned for changes that can not be replicated but should not be retried, like
+// files that are blocked here or have since been removed from the peer.
+var errSkipChange = errors.New("change skipped")
+
+// requireReplicaToken checks the -replicate:token a peer sends as a bearer token.
+func requireReplicaToken(w http.ResponseWriter, r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if *replicateToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(*replicateToken)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// backfillChanges adds every stored file to the changes feed the first time it is created, oldest first.
+func backfillChanges() {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM changes").Scan(&count); err != nil {
+		log.Fatalf("Failed to count changes: %v", err)
+	}
+	if count > 0 {
+		return
+	}
+	if _, err := db.Exec("INSERT INTO changes (data_id, changed) SELECT id, uploaded FROM data ORDER BY uploaded, id"); err != nil {
+		log.Fatalf("Failed to fill the changes feed: %v", err)
+	}
+}
+
+// handleChanges returns the files added after a sequence number, like /replicate/changes?since=0.
+func handleChanges(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w, r, adminCors)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if !requireReplicaToken(w, r) {
+		return
+	}
+
+	params := r.URL.Query()
+	since, err := strconv.ParseInt(params.Get("since"), 10, 64)
+	if params.Get("since") != "" && (err != nil || since < 0) {
+		http.Error(w, "Invalid since", http.StatusBadRequest)
+		return
+	}
+	limit := changesBatch
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, 1000)
+	}
+
+	rows, err := db.Query(`SELECT c.seq, c.changed, d.sha256, d.sha1, d.md5, d.crc32, d.ahash, d.dhash, d.type, d.size, d.uploaded
+		FROM changes c JOIN data d ON d.id = c.data_id WHERE c.seq > ? ORDER BY c.seq LIMIT ?`, since, limit)
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	settled := time.Now().Add(-changesSettle).Unix()
+	changes := []Change{}
+	for rows.Next() {
+		var c Change
+		var changed int64
+		var ahash, dhash, contentType sql.NullString
+		var size sql.NullInt64
+		if err := rows.Scan(&c.Seq, &changed, &c.SHA256, &c.SHA1, &c.MD5, &c.CRC32, &ahash, &dhash, &contentType, &size, &c.Uploaded); err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			return
+		}
+		// Stop at the first recent change, the ones after it are sent once it has settled
+		if changed > settled {
+			break
+		}
+		c.AHash = ahash.String
+		c.DHash = dhash.String
+		c.Type = contentType.String
+		c.Size = size.Int64
+		changes = append(changes, c)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Changes []Change `json:"changes"`
+	}{changes})
+}
+
+// handleReplicaBlob sends a stored file to a peer, like /replicate/blob/{sha256}. Unlike /get it
+// does not need a signature, since peers authenticate with the replication token.
+func handleReplicaBlob(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w, r, adminCors)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if !requireReplicaToken(w, r) {
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/replicate/blob/")
+	blocked, _, err := blockedByID(id)
+	if err != nil {
+		http.Error(w, "Failed to check blocklist", http.StatusInternalServerError)
+		return
+	}
+	if blocked {
+		http.Error(w, "This file has been blocked", http.StatusUnavailableForLegalReasons)
+		return
+	}
+	path, err := resolveBlob(id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "Failed to open file", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	if info, err := file.Stat(); err == nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	io.Copy(w, file)
+}
+
+// replicaPeers returns the base URLs of the peers given with -replicate:peers.
+func replicaPeers() []string {
+	var peers []string
+	for _, peer := range splitList(*replicatePeers) {
+		peers = append(peers, strings.TrimSuffix(peer, "/"))
+	}
+	return peers
+}
+
+// replicaGet sends an authenticated request to a peer.
+func replicaGet(url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+*replicateToken)
+	req.Header.Set("User-Agent", "yapc/"+version)
+	return replicaClient.Do(req)
+}
+
+// followPeers pulls new files from every peer in the background, every -replicate:interval.
+func followPeers() {
+	for _, peer := range replicaPeers() {
+		go func(peer string) {
+			for {
+				if err := pullChanges(peer); err != nil {
+					logger.Printf("Failed to replicate from %s: %v", peer, err)
+				}
+				time.Sleep(*replicateInterval)
+			}
+		}(peer)
+	}
+}
+
+// replicaCheckpoint returns the sequence number of the last change pulled from a peer.
+func replicaCheckpoint(peer string) (int64, error) {
+	var seq int64
+	err := db.QueryRow("SELECT seq FROM replication WHERE peer = ?", peer).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return seq, err
+}
+
+func saveReplicaCheckpoint(peer string, seq int64) error {
+	now := time.Now().Unix()
+	result, err := db.Exec("UPDATE replication SET seq = ?, updated = ? WHERE peer = ?", seq, now, peer)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		return nil
+	}
+	_, err = db.Exec("INSERT INTO replication (peer, seq, updated) VALUES (?, ?, ?)", peer, seq, now)
+	return err
+}
+
+// pullChanges replicates the files added to a peer since the last checkpoint. The checkpoint is
+// saved after every change, so an interrupted pull continues where it stopped.
+func pullChanges(peer string) error {
+	seq, err := replicaCheckpoint(peer)
+	if err != nil {
+		return err
+	}
+
+	for {
+		resp, err := replicaGet(fmt.Sprintf("%s/replicate/changes?since=%d&limit=%d", peer, seq, changesBatch))
+		if err != nil {
+			return err
+		}
+		var feed struct {
+			Changes []Change `json:"changes"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("peer returned %s", resp.Status)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&feed)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, c := range feed.Changes {
+			err := replicateChange(peer, c)
+			if errors.Is(err, errSkipChange) {
+				logLevelln(1, fmt.Sprintf("Skipped %s from %s: %v", c.SHA256, peer, err))
+			} else if err != nil {
+				return fmt.Errorf("failed to replicate %s: %v", c.SHA256, err)
+			}
+			seq = c.Seq
+			if err := saveReplicaCheckpoint(peer, seq); err != nil {
+				return err
+			}
+		}
+		if len(feed.Changes) < changesBatch {
+			return nil
+		}
+	}
+}
+
+// replicateChange stores a file from a peer unless it is already known here. Files that are known
+// but missing, like quarantined files, are not fetched again.
+func replicateChange(peer string, c Change) error {
+	if !isSHA256(c.SHA256) {
+		return fmt.Errorf("%w: invalid sha256", errSkipChange)
+	}
+	var exists int
+	if err := db.QueryRow("SELECT COUNT(*) FROM data WHERE id = ?", c.SHA256).Scan(&exists); err != nil {
+		return err
+	}
+	if exists > 0 {
+		return nil
+	}
+
+	created, err := pullBlob(peer, c.SHA256)
+	if err != nil {
+		return err
+	}
+	// Keep the time the file was first uploaded, so both instances list it the same way
+	if created && c.Uploaded > 0 {
+		if _, err := db.Exec("UPDATE data SET uploaded = ? WHERE id = ?", c.Uploaded, c.SHA256); err != nil {
+			return err
+		}
+	}
+	logLevelln(1, "Replicated "+c.SHA256+" from "+peer)
+	return nil
+}
+
+// pullBlob downloads a file from a peer into a temporary file while hashing it, checks its sha256
+// and stores it like an upload.
+func pullBlob(peer, id string) (bool, error) {
+	resp, err := replicaGet(peer + "/replicate/blob/" + id)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusUnavailableForLegalReasons:
+		return false, fmt.Errorf("%w: peer returned %s", errSkipChange, resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return false, fmt.Errorf("peer returned %s", resp.Status)
+	}
+
+	// Hidden, so the scrubber does not see a pull in progress as an orphan
+	tmp, err := os.CreateTemp(*dataDir, ".replicate-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+
+	hashes, contentType, size, err := copyHashes(tmp, io.LimitReader(resp.Body, *maxFileSize+1))
+	tmp.Close()
+	if err != nil {
+		return false, err
+	}
+	if size > *maxFileSize {
+		return false, fmt.Errorf("%w: file too large", errSkipChange)
+	}
+	if hashes["sha256"] != id {
+		return false, fmt.Errorf("%w: peer copy has sha256 %s", errSkipChange, hashes["sha256"])
+	}
+
+	if isHashableImage(contentType) {
+		file, err := os.Open(tmp.Name())
+		if err != nil {
+			return false, err
+		}
+		hashes["ahash"], hashes["dhash"], err = perceptualHashes(file)
+		file.Close()
+		if err != nil {
+			logger.Println("Failed to compute perceptual hashes", err)
+		}
+	}
+
+	created, err := saveBlob(hashes, contentType, size, func(filename string) error {
+		return os.Rename(tmp.Name(), filename)
+	})
+	if err == errBlocked {
+		return false, fmt.Errorf("%w: blocked", errSkipChange)
+	}
+	return created, err
+}
+
+const (
+	// peerMissTTL is how long a file the peers could not give is not asked for again.
+	peerMissTTL = time.Minute
+	// maxPeerMisses limits how many of those files are remembered.
+	maxPeerMisses = 10000
+)
+
+// peerFetches holds the fallback fetches in progress, so concurrent requests for a file share one
+// fetch, and the files the peers recently failed to give.
+var peerFetches = struct {
+	sync.Mutex
+	pending map[string]*peerFetch
+	misses  map[string]time.Time
+}{pending: map[string]*peerFetch{}, misses: map[string]time.Time{}}
+
+type peerFetch struct {
+	done chan struct{}
+	ok   bool
+}
+
+// fetchFromPeers tries to fetch a file that is not stored here from the peers, for -replicate:fallback.
+// Files that are known here, even if their data is missing, are left alone.
+func fetchFromPeers(id string) bool {
+	var exists int
+	if err := db.QueryRow("SELECT COUNT(*) FROM data WHERE id = ?", id).Scan(&exists); err != nil || exists > 0 {
+		return false
+	}
+
+	peerFetches.Lock()
+	if until, ok := peerFetches.misses[id]; ok {
+		if time.Now().Before(until) {
+			peerFetches.Unlock()
+			return false
+		}
+		delete(peerFetches.misses, id)
+	}
+	if f, ok := peerFetches.pending[id]; ok {
+		peerFetches.Unlock()
+		<-f.done
+		return f.ok
+	}
+	f := &peerFetch{done: make(chan struct{})}
+	peerFetches.pending[id] = f
+	peerFetches.Unlock()
+
+	f.ok = pullFromPeers(id)
+
+	peerFetches.Lock()
+	delete(peerFetches.pending, id)
+	if !f.ok {
+		rememberPeerMiss(id)
+	}
+	peerFetches.Unlock()
+	close(f.done)
+	return f.ok
+}
+
+// rememberPeerMiss remembers that the peers did not give a file. The caller must hold the lock.
+func rememberPeerMiss(id string) {
+	now := time.Now()
+	if len(peerFetches.misses) >= maxPeerMisses {
+		for old, until := range peerFetches.misses {
+			if now.After(until) {
+				delete(peerFetches.misses, old)
+			}
+		}
+		if len(peerFetches.misses) >= maxPeerMisses {
+			return
+		}
+	}
+	peerFetches.misses[id] = now.Add(peerMissTTL)
+}
+
+// pullFromPeers asks every peer for a file until one of them has it.
+func pullFromPeers(id string) bool {
+	for _, peer := range replicaPeers() {
+		if _, err := pullBlob(peer, id); err == nil {
+			logLevelln(1, "Fetched "+id+" from "+peer)
+			return true
+		} else if !errors.Is(err, errSkipChange) {
+			logger.Printf("Failed to fetch %s from %s: %v", id, peer, err)
+		}
+	}
+	return false
+}
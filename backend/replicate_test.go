@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFetchFromPeers(t *testing.T) {
+	setupTestDB(t)
+	t.Cleanup(func() {
+		peerFetches.Lock()
+		peerFetches.misses = map[string]time.Time{}
+		peerFetches.Unlock()
+	})
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 16, 16))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	sum := sha256.Sum256(data)
+	id := hex.EncodeToString(sum[:])
+	missing := strings.Repeat("ab", 32)
+
+	var requests int64
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/replicate/blob/"+id {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(peer.Close)
+	setFlag(t, replicatePeers, peer.URL)
+	setFlag(t, replicateToken, "secret")
+
+	if !fetchFromPeers(id) {
+		t.Fatal("file was not fetched from the peer")
+	}
+	path, err := resolveBlob(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := os.ReadFile(path); !bytes.Equal(stored, data) {
+		t.Error("stored file differs from the peer copy")
+	}
+	// The hashes are the same as those of an upload
+	want, contentType := computeHashes(data)
+	got, err := storedResponse(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.SHA1 != want["sha1"] || got.MD5 != want["md5"] || got.CRC32 != want["crc32"] || got.AHash != want["ahash"] || got.DHash != want["dhash"] || got.Type != contentType {
+		t.Errorf("stored hashes = %+v, want %v %s", got, want, contentType)
+	}
+
+	// A file the peers do not have is not asked for again right away
+	atomic.StoreInt64(&requests, 0)
+	if fetchFromPeers(missing) || fetchFromPeers(missing) {
+		t.Fatal("missing file was fetched")
+	}
+	if n := atomic.LoadInt64(&requests); n != 1 {
+		t.Errorf("peer got %d requests for a missing file, want 1", n)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ScrubIssue is a single problem found by the scrubber.
+type ScrubIssue struct {
+	ID string `json:"id"`
+	// Problem is "orphan" for files without a database entry, "missing" for entries without a file
+	// and "corrupt" for files that no longer match their sha256.
+	Problem string `json:"problem"`
+	// Action is what was done to repair the problem, it is empty in dry runs.
+	Action string `json:"action,omitempty"`
+}
+
+type ScrubReport struct {
+	Dry      bool         `json:"dry"`
+	Started  int64        `json:"started"`
+	Finished int64        `json:"finished"`
+	Checked  int64        `json:"checked"`
+	Issues   []ScrubIssue `json:"issues"`
+
+	mu    sync.Mutex
+	jobID string
+	seen  map[string]bool
+}
+
+// orphanMinAge is how old a file without a database entry has to be before the scrubber treats it
+// as an orphan. Uploads write the file before its entry, so newer files may still be uploading.
+const orphanMinAge = 5 * time.Minute
+
+// add records an issue. Issues are saved with the job, so a scrub that is resumed after a restart
+// still reports what it found before. An issue that was already found is not added again.
+func (r *ScrubReport) add(issue ScrubIssue) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Checked++
+	if r.seen[issue.ID+" "+issue.Problem] {
+		return
+	}
+	r.seen[issue.ID+" "+issue.Problem] = true
+	r.Issues = append(r.Issues, issue)
+
+	_, err := db.Exec("INSERT INTO scrub_issues (job_id, id, problem, action) VALUES (?, ?, ?, ?)", r.jobID, issue.ID, issue.Problem, issue.Action)
+	if err != nil {
+		logger.Printf("Failed to save scrub issue %s: %v", issue.ID, err)
+	}
+}
+
+func (r *ScrubReport) ok() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Checked++
+}
+
+var (
+	lastScrubReport *ScrubReport
+	lastScrubMu     sync.Mutex
+)
+
+// scrubJob runs the scrubber as a background job, the report can be fetched from /admin/scrub.
+func scrubJob(job *Job, dry bool) error {
+	report, err := scrub(job, dry)
+	if report != nil {
+		lastScrubMu.Lock()
+		lastScrubReport = report
+		lastScrubMu.Unlock()
+	}
+	return err
+}
+
+// runScrub runs the scrubber on startup when -scrub is set, writes the report as JSON to
+// -scrub:report or stdout and exits.
+func runScrub() {
+	report, err := scrub(&Job{ID: "scrub", Name: "scrub"}, !*scrubRepair)
+	if report != nil {
+		out := os.Stdout
+		if *scrubReport != "" {
+			file, err := os.Create(*scrubReport)
+			if err != nil {
+				log.Fatalf("Failed to create report: %v", err)
+			}
+			defer file.Close()
+			out = file
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// scrub checks the data folder and the database against each other. It finds files without a
+// database entry, entries without a file, and files that no longer hash to their sha256 name.
+// Unless dry is set the problems are repaired: orphans are hashed and inserted, missing and corrupt
+// files are fetched from -scrub:mirror if one is set, otherwise missing entries are deleted and
+// corrupt files are quarantined.
+func scrub(job *Job, dry bool) (*ScrubReport, error) {
+	report, err := newScrubReport(job, dry)
+	if err != nil {
+		return nil, err
+	}
+
+	logLevelln(0, "Scrubbing database entries")
+	err = forEachID(job, "data", "id NOT IN (SELECT id FROM quarantine)", func(id string) {
+		filePath, err := resolveBlob(id)
+		if os.IsNotExist(err) {
+			issue := ScrubIssue{ID: id, Problem: "missing"}
+			if !dry {
+				issue.Action = repairMissing(id)
+			}
+			report.add(issue)
+			return
+		}
+
+		sum, err := sha256File(filePath)
+		if err != nil {
+			logger.Printf("Failed to hash %s: %v", filePath, err)
+			return
+		}
+
+		if sum != id {
+			issue := ScrubIssue{ID: id, Problem: "corrupt"}
+			if !dry {
+				issue.Action = repairCorrupt(id)
+			}
+			report.add(issue)
+			return
+		}
+
+		report.ok()
+	})
+	if err != nil {
+		return report, err
+	}
+
+	logLevelln(0, "Scrubbing data folder")
+	err = walkBlobs(func(id, path string) error {
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM data WHERE id = ?", id).Scan(&count); err != nil {
+			return fmt.Errorf("failed to query database: %v", err)
+		}
+		if count > 0 {
+			return nil
+		}
+		if info, err := os.Stat(path); err != nil || time.Since(info.ModTime()) < orphanMinAge {
+			return nil
+		}
+
+		issue := ScrubIssue{ID: id, Problem: "orphan"}
+		if !dry {
+			issue.Action = repairOrphan(id, path)
+		}
+		report.add(issue)
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	report.Finished = time.Now().Unix()
+	logLevelln(0, fmt.Sprintf("Scrub found %d issues in %d files", len(report.Issues), report.Checked))
+	return report, nil
+}
+
+// newScrubReport returns the report for a scrub. A scrub that resumes from a checkpoint continues
+// the report it had, a new scrub clears the issues of earlier ones.
+func newScrubReport(job *Job, dry bool) (*ScrubReport, error) {
+	report := &ScrubReport{Dry: dry, Started: job.Started, Issues: []ScrubIssue{}, jobID: job.ID, seen: map[string]bool{}}
+	if report.Started == 0 {
+		report.Started = time.Now().Unix()
+	}
+
+	if job.checkpoint() == "" {
+		if _, err := db.Exec("DELETE FROM scrub_issues"); err != nil {
+			return nil, fmt.Errorf("failed to clear scrub issues: %v", err)
+		}
+		return report, nil
+	}
+
+	rows, err := db.Query("SELECT id, problem, action FROM scrub_issues WHERE job_id = ?", job.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load scrub issues: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var issue ScrubIssue
+		var action sql.NullString
+		if err := rows.Scan(&issue.ID, &issue.Problem, &action); err != nil {
+			return nil, fmt.Errorf("failed to load scrub issues: %v", err)
+		}
+		issue.Action = action.String
+		report.Issues = append(report.Issues, issue)
+		report.seen[issue.ID+" "+issue.Problem] = true
+	}
+	report.Checked = atomic.LoadInt64(&job.Done)
+	return report, rows.Err()
+}
+
+func sha256File(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func repairMissing(id string) string {
+	if *scrubMirror != "" {
+		err := fetchFromMirror(id)
+		if err == nil {
+			return "fetched"
+		}
+		logger.Printf("Failed to fetch %s from mirror: %v", id, err)
+	}
+	if _, err := db.Exec("DELETE FROM data WHERE id = ?", id); err != nil {
+		return "failed: " + err.Error()
+	}
+	return "deleted"
+}
+
+func repairCorrupt(id string) string {
+	if *scrubMirror != "" {
+		err := fetchFromMirror(id)
+		if err == nil {
+			return "fetched"
+		}
+		logger.Printf("Failed to fetch %s from mirror: %v", id, err)
+	}
+	if err := quarantineUpload(id, "checksum mismatch"); err != nil {
+		return "failed: " + err.Error()
+	}
+	return "quarantined"
+}
+
+// repairOrphan hashes a file without a database entry and inserts it. Orphans whose content does not
+// match their name are moved to the quarantine folder instead.
+func repairOrphan(id, filePath string) string {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return "failed: " + err.Error()
+	}
+
+	hashes, contentType := computeHashes(data)
+	if hashes["sha256"] != id {
+		if err := os.MkdirAll(quarantineDir(), 0755); err != nil {
+			return "failed: " + err.Error()
+		}
+		if err := os.Rename(filePath, filepath.Join(quarantineDir(), id)); err != nil {
+			return "failed: " + err.Error()
+		}
+		return "quarantined"
+	}
+
+	if err := insertData(hashes, contentType, int64(len(data)), time.Now().Unix()); err != nil {
+		return "failed: " + err.Error()
+	}
+	return "reinserted"
+}
+
+// fetchFromMirror downloads a file from -scrub:mirror and replaces the local copy if its sha256 matches.
+func fetchFromMirror(id string) error {
+	client := &http.Client{Timeout: 10 * time.Minute}
+	resp, err := client.Get(strings.TrimSuffix(*scrubMirror, "/") + "/get/" + id)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("mirror returned %s", resp.Status)
+	}
+
+	tmp, err := os.CreateTemp(*dataDir, ".scrub-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hasher), resp.Body)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(hasher.Sum(nil)); sum != id {
+		return fmt.Errorf("mirror copy has sha256 %s", sum)
+	}
+
+	path, err := prepareBlobPath(id)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func handleAdminScrub(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w, r, adminCors)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method, use GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	lastScrubMu.Lock()
+	report := lastScrubReport
+	lastScrubMu.Unlock()
+	if report == nil {
+		http.Error(w, "No scrub has finished yet, start one with the scrub job", http.StatusNotFound)
+		return
+	}
+
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"testing"
+	"time"
+)
+
+// writeOrphan stores a file in the data folder without a database entry.
+func writeOrphan(t *testing.T, data string, modified time.Time) string {
+	t.Helper()
+	sum := sha256.Sum256([]byte(data))
+	id := hex.EncodeToString(sum[:])
+	path, err := prepareBlobPath(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestScrubOrphanAge(t *testing.T) {
+	setupTestDB(t)
+	old := writeOrphan(t, "left behind", time.Now().Add(-time.Hour))
+	writeOrphan(t, "still uploading", time.Now())
+
+	report, err := scrub(&Job{ID: "scrub", Name: "scrub"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Issues) != 1 || report.Issues[0].ID != old || report.Issues[0].Action != "reinserted" {
+		t.Fatalf("issues = %+v, want only the old orphan reinserted", report.Issues)
+	}
+	if !dataExists(t, old) {
+		t.Error("old orphan was not reinserted")
+	}
+}
+
+func TestScrubResume(t *testing.T) {
+	setupTestDB(t)
+	writeOrphan(t, "orphan", time.Now().Add(-time.Hour))
+
+	job := &Job{ID: "first", Name: "scrub"}
+	report, err := scrub(job, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Issues) != 1 {
+		t.Fatalf("issues = %+v, want one orphan", report.Issues)
+	}
+
+	// A scrub resumed from its checkpoint keeps the issues it found, without adding them twice
+	job.Checkpoint = "ffff"
+	report, err = scrub(job, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Issues) != 1 || report.Issues[0].Problem != "orphan" {
+		t.Errorf("resumed issues = %+v, want the one orphan", report.Issues)
+	}
+
+	// A new scrub starts with an empty report
+	if _, err := db.Exec("INSERT INTO scrub_issues (job_id, id, problem, action) VALUES ('first', 'gone', 'missing', '')"); err != nil {
+		t.Fatal(err)
+	}
+	report, err = scrub(&Job{ID: "second", Name: "scrub"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, issue := range report.Issues {
+		if issue.ID == "gone" {
+			t.Error("new scrub reported an issue of an earlier one")
+		}
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM scrub_issues WHERE job_id = 'first'").Scan(&count); err != nil || count != 0 {
+		t.Errorf("issues of the earlier scrub = %d, %v, want 0", count, err)
+	}
+}
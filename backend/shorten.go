@@ -0,0 +1,452 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	errSlugTaken = errors.New("slug is already taken")
+
+	slugPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{3,64}$`)
+
+	// reservedSlugs can not be used as custom slugs, since they could be mistaken for pages of the
+	// instance itself.
+	reservedSlugs = map[string]bool{
+		"admin": true, "album": true, "api": true, "bundle": true, "exists": true, "fetch": true,
+		"get": true, "get2": true, "health": true, "img": true, "load": true, "login": true,
+		"lookup": true, "p": true, "paste": true, "ping": true, "qr": true, "raw": true,
+		"replicate": true, "shorten": true, "stats": true, "store": true, "u": true, "upload": true,
+		"zip": true,
+	}
+)
+
+// validSlug reports why a custom slug can not be used, or returns an empty string if it can.
+func validSlug(slug string) string {
+	if !slugPattern.MatchString(slug) {
+		return "Slug must be 3 to 64 letters, digits, - or _"
+	}
+	if reservedSlugs[strings.ToLower(slug)] {
+		return "Slug is reserved"
+	}
+	return ""
+}
+
+// insertShortLink stores a short link. errSlugTaken is returned if the id is already used.
+func insertShortLink(link ShortLink, custom bool, tokenHash string) error {
+	_, err := db.Exec("INSERT INTO urls (id, url, hits, uploaded, custom, expires, max_hits, disabled, token) VALUES (?, ?, 0, ?, ?, ?, ?, 0, ?)",
+		link.ID, link.URL, time.Now().Unix(), boolInt(custom), link.Expires, link.MaxHits, tokenHash)
+	if err == nil {
+		return nil
+	}
+
+	// The error of a duplicate key differs between databases, so look the id up instead
+	var exists int
+	if db.QueryRow("SELECT COUNT(*) FROM urls WHERE id = ?", link.ID).Scan(&exists) == nil && exists > 0 {
+		return errSlugTaken
+	}
+	return err
+}
+
+// createShortLink stores a short link with a random id, and tries again with a new id if it is taken.
+func createShortLink(link ShortLink, tokenHash string) (string, error) {
+	for i := 0; i < 5; i++ {
+		link.ID = randomBase62(*shortenLength)
+		err := insertShortLink(link, false, tokenHash)
+		if err == errSlugTaken {
+			logLevelln(1, "Short link id collision, retrying")
+			continue
+		}
+		return link.ID, err
+	}
+	return "", errors.New("failed to find an unused short link id")
+}
+
+// getShortLink returns a short link and the hash of its edit token.
+func getShortLink(id string) (ShortLink, string, error) {
+	var l ShortLink
+	var hits, uploaded sql.NullInt64
+	var disabled int
+	var token sql.NullString
+	err := db.QueryRow("SELECT id, url, hits, uploaded, expires, max_hits, disabled, token FROM urls WHERE id = ?", id).
+		Scan(&l.ID, &l.URL, &hits, &uploaded, &l.Expires, &l.MaxHits, &disabled, &token)
+	l.Hits = hits.Int64
+	l.Uploaded = uploaded.Int64
+	l.Disabled = disabled == 1
+	return l, token.String, err
+}
+
+// deleteShortLink deletes a short link and its clicks.
+func deleteShortLink(id string) error {
+	if _, err := db.Exec("DELETE FROM urls WHERE id = ?", id); err != nil {
+		return err
+	}
+	_, err := db.Exec("DELETE FROM clicks WHERE url_id = ?", id)
+	return err
+}
+
+// hashToken returns the hash of an edit token, only the hash is stored.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// requireLinkToken checks that a request has the edit token of a short link, or the admin token.
+// Links created before edit tokens existed can only be managed by admins.
+func requireLinkToken(w http.ResponseWriter, r *http.Request, tokenHash string) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if *adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) == 1 {
+		return true
+	}
+	if token == "" || tokenHash == "" || subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(tokenHash)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// expiryValue is an expiry in seconds or as a duration like 24h. It can be given as a JSON number or string.
+type expiryValue string
+
+func (e *expiryValue) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*e = expiryValue(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return err
+	}
+	*e = expiryValue(n.String())
+	return nil
+}
+
+// expiresAt returns the unix time an expiry ends at, or 0 if it is empty or zero.
+func (e expiryValue) expiresAt() (int64, error) {
+	d, err := parseExpiry(string(e))
+	if err != nil || d < 0 {
+		return 0, errors.New("invalid expiry")
+	}
+	if d == 0 {
+		return 0, nil
+	}
+	return time.Now().Add(d).Unix(), nil
+}
+
+// validTarget reports why a URL can not be shortened, or returns an empty string if it can.
+func validTarget(target string) string {
+	if len(target) > 2048 {
+		return "Url is too long (>2048 characters)"
+	}
+	// Check the scheme first, since URLs like javascript: have no host and would be invalid anyway
+	if u, err := url.Parse(target); err == nil && !schemeAllowed(u.Scheme) {
+		return "Url scheme is not allowed, use one of " + strings.Join(splitList(*shortenSchemes), ", ")
+	}
+	if !isValidURL(target) {
+		return "Url is not valid"
+	}
+	switch err := checkDestination(target, true); err {
+	case nil:
+		return ""
+	case errPrivateHost:
+		return "Url points to a private address"
+	case errBlockedDomain:
+		return "This domain is blocked"
+	default:
+		return "Url host could not be resolved"
+	}
+}
+
+// migrateShortLinkIDs makes short link ids case sensitive on mysql, where they are compared case
+// insensitively by default and two random base62 ids could otherwise collide. Ids created from the
+// crc64 of the URL are lowercase hex and keep resolving as before.
+func migrateShortLinkIDs() {
+	if *dbType != "mysql" {
+		return
+	}
+	done, err := getMeta("urls_id_binary")
+	if err != nil {
+		log.Fatalf("Failed to read meta: %v", err)
+	}
+	if done != "" {
+		return
+	}
+	_, err = db.Exec("ALTER TABLE urls MODIFY id VARCHAR(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL")
+	if err != nil {
+		log.Fatalf("Failed to migrate urls table: %v", err)
+	}
+	if err := setMeta("urls_id_binary", "1"); err != nil {
+		log.Fatalf("Failed to write meta: %v", err)
+	}
+}
+
+func handleShorten(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w, r, apiCors)
+	type ShortenResponse struct {
+		Success bool   `json:"success"`
+		Error   string `json:"error"`
+		ID      string `json:"id"`
+		URL     string `json:"url,omitempty"`
+		// Token is needed to edit or delete the link, it is only returned once
+		Token   string `json:"token,omitempty"`
+		Expires int64  `json:"expires,omitempty"`
+		MaxHits int64  `json:"max_hits,omitempty"`
+	}
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	respond := func(status int, response ShortenResponse) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		enc.Encode(response)
+	}
+
+	var request struct {
+		URL     string      `json:"url"`
+		Slug    string      `json:"slug"`
+		Expires expiryValue `json:"expires"`
+		MaxHits int64       `json:"max_hits"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if msg := validTarget(request.URL); msg != "" {
+		respond(http.StatusBadRequest, ShortenResponse{Error: msg})
+		return
+	}
+	expires, err := request.Expires.expiresAt()
+	if err != nil {
+		respond(http.StatusBadRequest, ShortenResponse{Error: "Invalid expiry"})
+		return
+	}
+	if request.MaxHits < 0 {
+		respond(http.StatusBadRequest, ShortenResponse{Error: "Invalid max_hits"})
+		return
+	}
+
+	// Every link gets its own id and token, so the owner of one link can not change where another
+	// link to the same URL points to
+	link := ShortLink{URL: request.URL, Expires: expires, MaxHits: request.MaxHits}
+	token := randomHex(16)
+
+	if request.Slug != "" {
+		if msg := validSlug(request.Slug); msg != "" {
+			respond(http.StatusBadRequest, ShortenResponse{Error: msg})
+			return
+		}
+		link.ID = request.Slug
+		err = insertShortLink(link, true, hashToken(token))
+		if err == errSlugTaken {
+			respond(http.StatusConflict, ShortenResponse{Error: "Slug is already taken"})
+			return
+		}
+	} else {
+		link.ID, err = createShortLink(link, hashToken(token))
+	}
+	if err != nil {
+		logger.Println("Failed to store short link", err)
+		respond(http.StatusInternalServerError, ShortenResponse{Error: "Failed to store URL"})
+		return
+	}
+
+	respond(http.StatusCreated, ShortenResponse{
+		Success: true,
+		ID:      link.ID,
+		URL:     baseURL(r) + "/u/" + link.ID,
+		Token:   token,
+		Expires: link.Expires,
+		MaxHits: link.MaxHits,
+	})
+}
+
+// handleShortLink shows, edits and deletes a short link with its edit token.
+func handleShortLink(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w, r, apiCors)
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/shorten/"), "/")
+	link, tokenHash, err := getShortLink(id)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		return
+	}
+	if !requireLinkToken(w, r, tokenHash) {
+		return
+	}
+
+	switch sub {
+	case "":
+	case "stats":
+		handleShortLinkStats(w, r, link)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPatch:
+		var request struct {
+			URL      *string      `json:"url"`
+			Expires  *expiryValue `json:"expires"`
+			MaxHits  *int64       `json:"max_hits"`
+			Disabled *bool        `json:"disabled"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&request); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if request.URL != nil {
+			if msg := validTarget(*request.URL); msg != "" {
+				http.Error(w, msg, http.StatusBadRequest)
+				return
+			}
+			link.URL = *request.URL
+		}
+		if request.Expires != nil {
+			if link.Expires, err = request.Expires.expiresAt(); err != nil {
+				http.Error(w, "Invalid expiry", http.StatusBadRequest)
+				return
+			}
+		}
+		if request.MaxHits != nil {
+			if *request.MaxHits < 0 {
+				http.Error(w, "Invalid max_hits", http.StatusBadRequest)
+				return
+			}
+			link.MaxHits = *request.MaxHits
+		}
+		if request.Disabled != nil {
+			link.Disabled = *request.Disabled
+		}
+
+		_, err := db.Exec("UPDATE urls SET url = ?, expires = ?, max_hits = ?, disabled = ? WHERE id = ?",
+			link.URL, link.Expires, link.MaxHits, boolInt(link.Disabled), link.ID)
+		if err != nil {
+			http.Error(w, "Failed to update URL", http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodDelete:
+		if err := deleteShortLink(link.ID); err != nil {
+			http.Error(w, "Failed to delete URL", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(link)
+}
+
+var previewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Link preview</title>
+<style>
+body { margin: 0 auto; max-width: 640px; padding: 32px 16px; font: 16px/1.5 system-ui, sans-serif; }
+code { display: block; padding: 12px; background: #f0f0f0; word-break: break-all; }
+</style>
+</head>
+<body>
+<p>This link goes to:</p>
+<code>{{.URL}}</code>
+<p><a href="/u/{{.ID}}?go=1">Continue</a></p>
+</body>
+</html>
+`))
+
+func handleU(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w, r, apiCors)
+	id := r.URL.Path[len("/u/"):]
+
+	var url string
+	var expires int64
+	var disabled int
+	err := db.QueryRow("SELECT url, expires, disabled FROM urls WHERE id = ?", id).Scan(&url, &expires, &disabled)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, "Failed to retrieve URL", http.StatusInternalServerError)
+		}
+		return
+	}
+	if disabled == 1 {
+		http.Error(w, "This link has been disabled", http.StatusGone)
+		return
+	}
+	if expires > 0 && time.Now().Unix() > expires {
+		http.Error(w, "This link has expired", http.StatusGone)
+		return
+	}
+	// The blocklist can have changed since the link was created
+	if checkDestination(url, false) != nil {
+		http.Error(w, "This link has been blocked", http.StatusUnavailableForLegalReasons)
+		return
+	}
+
+	params := r.URL.Query()
+	if (*shortenPreview || parseBool(params.Get("preview"))) && !parseBool(params.Get("go")) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if err := previewTemplate.Execute(w, struct{ ID, URL string }{id, url}); err != nil {
+			logger.Println("Failed to render preview", err)
+		}
+		return
+	}
+
+	// Increment the hits counter for the URL, the condition makes sure concurrent requests can not
+	// go over the limit
+	res, err := db.Exec("UPDATE urls SET hits = hits + 1 WHERE id = ? AND (max_hits = 0 OR hits < max_hits)", id)
+	if err != nil {
+		log.Printf("Failed to increment hits for URL with id %s: %v", id, err)
+	} else if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "This link has expired", http.StatusGone)
+		return
+	}
+	queueClick(r, id)
+
+	http.Redirect(w, r, url, http.StatusFound)
+}
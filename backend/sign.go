@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignRequest is the body of a request to /admin/sign.
+type SignRequest struct {
+	Hash        string `json:"hash"`
+	Filename    string `json:"filename"`
+	Ext         string `json:"ext"`
+	ContentType string `json:"type"`
+	// Paste signs the page and raw text of a paste instead of a file.
+	Paste string `json:"paste"`
+	// Expires is how many seconds the link is valid for, -sign:maxage is used if it is 0.
+	Expires int64 `json:"expires"`
+}
+
+// signature returns the HMAC-SHA256 of a path and its query parameters, except sig.
+// The parameters are sorted by url.Values.Encode, so their order in the link does not matter.
+func signature(path string, query url.Values) string {
+	values := url.Values{}
+	for key, value := range query {
+		if key != "sig" {
+			values[key] = value
+		}
+	}
+
+	mac := hmac.New(sha256.New, []byte(*signKey))
+	mac.Write([]byte(path + "?" + values.Encode()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signURL adds an expiry and a signature to a path and its query parameters.
+func signURL(path string, query url.Values, expires time.Time) string {
+	query.Set("exp", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("sig", signature(path, query))
+	return path + "?" + query.Encode()
+}
+
+// signedLink returns a link to another page of a request that passed requireSignature. If the
+// request was signed, the link is signed with the same expiry, so links on a signed page keep working.
+func signedLink(r *http.Request, path string, query url.Values) string {
+	if exp, err := strconv.ParseInt(r.URL.Query().Get("exp"), 10, 64); err == nil && *signKey != "" && r.URL.Query().Get("sig") != "" {
+		return signURL(path, query, time.Unix(exp, 0))
+	}
+	if len(query) == 0 {
+		return path
+	}
+	return path + "?" + query.Encode()
+}
+
+// requireSignature checks the signature of a download. Links without a signature are only rejected
+// if -sign:require is set, but a signature that is present must always be valid.
+func requireSignature(w http.ResponseWriter, r *http.Request) bool {
+	if *signKey == "" {
+		return true
+	}
+
+	query := r.URL.Query()
+	sig := query.Get("sig")
+	if sig == "" {
+		if *signRequire {
+			http.Error(w, "This link must be signed", http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+
+	exp, err := strconv.ParseInt(query.Get("exp"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid expiry", http.StatusForbidden)
+		return false
+	}
+	if !hmac.Equal([]byte(sig), []byte(signature(r.URL.Path, query))) {
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return false
+	}
+	if time.Now().Unix() > exp {
+		http.Error(w, "This link has expired", http.StatusGone)
+		return false
+	}
+	return true
+}
+
+// cacheControl returns the Cache-Control header for content served from a file. Files can be blocked
+// or quarantined after they were first served, so shared caches may keep them for at most maxAge.
+// When signing is enabled the response is private, and a signed response is not kept past the
+// expiry of its link.
+func cacheControl(r *http.Request, maxAge time.Duration) string {
+	query := r.URL.Query()
+	if *signKey == "" && query.Get("sig") == "" && query.Get("exp") == "" {
+		return fmt.Sprintf("public, max-age=%d", int64(maxAge.Seconds()))
+	}
+	if query.Get("sig") == "" {
+		return fmt.Sprintf("private, max-age=%d", int64(maxAge.Seconds()))
+	}
+	exp, err := strconv.ParseInt(query.Get("exp"), 10, 64)
+	if err != nil {
+		return "private, no-store"
+	}
+	left := time.Until(time.Unix(exp, 0))
+	if left <= 0 {
+		return "private, no-store"
+	}
+	return fmt.Sprintf("private, max-age=%d", int64(min(left, maxAge).Seconds()))
+}
+
+// baseURL returns the scheme and host links to uploaded files should use. -public:url is used if
+// it is set, otherwise the URL is guessed from the request.
+func baseURL(r *http.Request) string {
+	if *publicURL != "" {
+		return strings.TrimSuffix(*publicURL, "/")
+	}
+
+	scheme := "http"
+	if r.TLS != nil || (*trustProxy && r.Header.Get("X-Forwarded-Proto") == "https") {
+		scheme = "https"
+	}
+	host := r.Host
+	if *contentHost != "" {
+		host = *contentHost
+	}
+	return scheme + "://" + host
+}
+
+func handleAdminSign(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w, r, adminCors)
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method, use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req SignRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Hash == "" && req.Paste == "" {
+		http.Error(w, "No hash or paste provided", http.StatusBadRequest)
+		return
+	}
+	if req.ContentType != "" && !contentTypeAllowed(req.ContentType) {
+		http.Error(w, "Content type not allowed", http.StatusBadRequest)
+		return
+	}
+
+	maxAge := *signMaxAge
+	if req.Expires > 0 {
+		maxAge = time.Duration(req.Expires) * time.Second
+	}
+	expires := time.Now().Add(maxAge)
+
+	response := map[string]interface{}{"expires": expires.Unix()}
+	// Plain sha256 links use /get, anything else needs the parameters of /get2. Pastes get a link to
+	// their page and to their raw text.
+	if req.Paste != "" {
+		response["url"] = baseURL(r) + signURL("/p/"+req.Paste, url.Values{}, expires)
+		response["raw"] = baseURL(r) + signURL("/raw/"+req.Paste, url.Values{}, expires)
+	} else if isSHA256(req.Hash) && req.Filename == "" && req.Ext == "" && req.ContentType == "" {
+		response["url"] = baseURL(r) + signURL("/get/"+req.Hash, url.Values{}, expires)
+	} else {
+		query := url.Values{"h": {req.Hash}}
+		if req.Filename != "" {
+			query.Set("f", req.Filename)
+		}
+		if req.Ext != "" {
+			query.Set("e", req.Ext)
+		}
+		if req.ContentType != "" {
+			query.Set("ct", req.ContentType)
+		}
+		response["url"] = baseURL(r) + signURL("/get2/", query, expires)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(response)
+}
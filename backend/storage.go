@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// blobPath returns where the file with the given sha256 is stored. Like git, files are spread over
+// two levels of folders named after the first four characters of the hash, for example
+// ab/cd/abcd..., so no folder grows too large.
+func blobPath(id string) string {
+	return filepath.Join(*dataDir, id[:2], id[2:4], id)
+}
+
+// legacyBlobPath returns where the file was stored before the sharded layout was introduced.
+func legacyBlobPath(id string) string {
+	return filepath.Join(*dataDir, id)
+}
+
+// resolveBlob returns the path of a stored file. Files that have not been moved by -migrate:layout
+// yet are found in the legacy flat layout. It returns an error satisfying os.IsNotExist if the file
+// does not exist or id is not a sha256 hash.
+func resolveBlob(id string) (string, error) {
+	if !isSHA256(id) {
+		return "", os.ErrNotExist
+	}
+
+	path := blobPath(id)
+	_, err := os.Stat(path)
+	if err == nil || !os.IsNotExist(err) {
+		return path, err
+	}
+
+	path = legacyBlobPath(id)
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// prepareBlobPath creates the folder a new file will be stored in and returns its path.
+func prepareBlobPath(id string) (string, error) {
+	path := blobPath(id)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// walkBlobs calls fn for every stored file in both the sharded and the legacy layout.
+// Files that are not named after a sha256 hash, such as the sqlite database, and hidden folders
+// such as the quarantine are skipped.
+func walkBlobs(fn func(id, path string) error) error {
+	return filepath.WalkDir(*dataDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != *dataDir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !isSHA256(d.Name()) {
+			return nil
+		}
+		return fn(d.Name(), path)
+	})
+}
+
+// migrateLayout moves files from the legacy flat layout into the sharded layout. Every file is moved
+// with a single rename, so the migration can be interrupted and resumed at any point.
+func migrateLayout(job *Job, dry bool) error {
+	files, err := os.ReadDir(*dataDir)
+	if err != nil {
+		return fmt.Errorf("failed to read data folder: %v", err)
+	}
+
+	var ids []string
+	for _, file := range files {
+		if !file.IsDir() && isSHA256(file.Name()) {
+			ids = append(ids, file.Name())
+		}
+	}
+	job.setTotal(int64(len(ids)))
+	logLevelln(0, fmt.Sprintf("Moving %d files to the sharded layout", len(ids)))
+
+	for _, id := range ids {
+		job.step()
+		if dry {
+			continue
+		}
+
+		newPath, err := prepareBlobPath(id)
+		if err != nil {
+			return err
+		}
+
+		// The file may already exist in the sharded layout, for example if the scrubber fetched it
+		// from a mirror, so the legacy copy is a duplicate.
+		if _, err := os.Stat(newPath); err == nil {
+			if err := os.Remove(legacyBlobPath(id)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := os.Rename(legacyBlobPath(id), newPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runMigrateLayout runs migrateLayout on startup when -migrate:layout is set.
+func runMigrateLayout() {
+	if err := migrateLayout(&Job{ID: "migrate", Name: "migrate"}, false); err != nil {
+		log.Fatalf("Failed to migrate data folder: %v", err)
+	}
+	logLevelln(0, "Finished migrating data folder")
+}
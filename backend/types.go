@@ -16,3 +16,104 @@ type UploadCommandRunner struct {
 	Dhash       string
 	ContentType string
 }
+
+type BlockEntry struct {
+	Hash     string `json:"hash"`
+	Algo     string `json:"algo"`
+	Distance *int   `json:"distance,omitempty"`
+	Reason   string `json:"reason"`
+	Source   string `json:"source"`
+	Added    int64  `json:"added"`
+}
+
+type StoreResponse struct {
+	SHA256 string `json:"sha256"`
+	SHA1   string `json:"sha1"`
+	MD5    string `json:"md5"`
+	CRC32  string `json:"crc32"`
+	AHash  string `json:"ahash"`
+	DHash  string `json:"dhash"`
+	Type   string `json:"type"`
+	// Stripped is true if metadata was removed from the file before it was stored
+	Stripped bool `json:"stripped"`
+}
+
+type UploadInfo struct {
+	ID          string `json:"id"`
+	SHA1        string `json:"sha1"`
+	MD5         string `json:"md5"`
+	CRC32       string `json:"crc32"`
+	Type        string `json:"type"`
+	Size        int64  `json:"size"`
+	Uploaded    int64  `json:"uploaded"`
+	Quarantined bool   `json:"quarantined"`
+}
+
+type ShortLink struct {
+	ID       string `json:"id"`
+	URL      string `json:"url"`
+	Hits     int64  `json:"hits"`
+	Uploaded int64  `json:"uploaded"`
+	// Expires is the unix time the link expires at, 0 if it never does
+	Expires int64 `json:"expires"`
+	// MaxHits is the number of redirects after which the link expires, 0 if there is no limit
+	MaxHits  int64 `json:"max_hits"`
+	Disabled bool  `json:"disabled"`
+}
+
+type Paste struct {
+	ID     string `json:"id"`
+	DataID string `json:"data_id"`
+	Lang   string `json:"lang"`
+	Burn   bool   `json:"burn"`
+	// Stored is true if the paste stored the data, so burning it may delete the file
+	Stored  bool  `json:"-"`
+	Expires int64 `json:"expires"`
+	Created int64 `json:"created"`
+}
+
+// FetchJob is a download of a remote URL into storage, started with /fetch.
+type FetchJob struct {
+	ID     string `json:"id"`
+	URL    string `json:"url"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Name is the filename taken from the response or the URL
+	Name     string `json:"name,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Created  int64  `json:"created"`
+	Finished int64  `json:"finished,omitempty"`
+
+	owner  string
+	ipHash string
+	strip  bool
+}
+
+type Album struct {
+	ID      string      `json:"id"`
+	Title   string      `json:"title"`
+	Created int64       `json:"created"`
+	Files   []AlbumFile `json:"files"`
+	// Zip is a link to download the album as a ZIP file
+	Zip string `json:"zip,omitempty"`
+}
+
+type AlbumFile struct {
+	SHA256 string `json:"sha256"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Size   int64  `json:"size"`
+}
+
+type UploadRecord struct {
+	ID           int64  `json:"id"`
+	DataID       string `json:"data_id"`
+	Name         string `json:"name"`
+	Size         int64  `json:"size"`
+	DeclaredType string `json:"declared_type"`
+	Type         string `json:"type"`
+	Owner        string `json:"owner"`
+	Uploaded     int64  `json:"uploaded"`
+}
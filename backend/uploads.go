@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ipSalt is mixed into client IP hashes so they can not be reversed by hashing every IPv4 address.
+var ipSalt string
+
+// initIPSalt loads the salt used by hashIP. If -ip:salt is not set a random salt is generated once
+// and stored in the database, so hashes stay comparable across restarts.
+func initIPSalt() {
+	if *ipSaltFlag != "" {
+		ipSalt = *ipSaltFlag
+		return
+	}
+
+	salt, err := getMeta("ip_salt")
+	if err != nil {
+		log.Fatalf("Failed to load ip salt: %v", err)
+	}
+	if salt == "" {
+		salt = randomHex(16)
+		if err := setMeta("ip_salt", salt); err != nil {
+			log.Fatalf("Failed to store ip salt: %v", err)
+		}
+	}
+	ipSalt = salt
+}
+
+// clientIP returns the IP address of the client. X-Forwarded-For and X-Real-IP are only used if
+// -trustproxy is set, since anyone can send them.
+func clientIP(r *http.Request) string {
+	if *trustProxy {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			ip, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(ip)
+		}
+		if ip := r.Header.Get("X-Real-IP"); ip != "" {
+			return ip
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// hashIP returns a salted sha256 hash of the client IP, so uploads from the same client can be
+// grouped without storing the address itself.
+func hashIP(r *http.Request) string {
+	sum := sha256.Sum256([]byte(ipSalt + clientIP(r)))
+	return hex.EncodeToString(sum[:])
+}
+
+// cleanFilename strips any path from a client supplied filename and limits its length.
+func cleanFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" {
+		return ""
+	}
+	if len(name) > 255 {
+		name = name[:255]
+	}
+	return name
+}
+
+// recordUpload stores an upload event for a file. Every upload gets its own row, even when the data
+// itself was already stored, so the original filename and declared type are kept per upload.
+func recordUpload(r *http.Request, header *multipart.FileHeader, dataID, sniffedType string) error {
+	u := UploadRecord{DataID: dataID, Type: sniffedType, Owner: r.FormValue("owner")}
+	if len(u.Owner) > 255 {
+		u.Owner = u.Owner[:255]
+	}
+	if header != nil {
+		u.Name = cleanFilename(header.Filename)
+		u.DeclaredType = header.Header.Get("Content-Type")
+		u.Size = header.Size
+	}
+	return insertUpload(u, hashIP(r))
+}
+
+// insertUpload stores an upload event made by the client with the given IP hash.
+func insertUpload(u UploadRecord, ipHash string) error {
+	_, err := db.Exec("INSERT INTO uploads (data_id, name, size, declared_type, type, ip_hash, owner, uploaded) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		u.DataID, u.Name, u.Size, u.DeclaredType, u.Type, ipHash, u.Owner, time.Now().Unix())
+	return err
+}
+
+// latestUpload returns the most recent upload event for a file.
+func latestUpload(dataID string) (UploadRecord, error) {
+	var u UploadRecord
+	var name, declaredType, sniffedType, owner sql.NullString
+	var size sql.NullInt64
+	err := db.QueryRow("SELECT id, data_id, name, size, declared_type, type, owner, uploaded FROM uploads WHERE data_id = ? ORDER BY uploaded DESC, id DESC LIMIT 1", dataID).
+		Scan(&u.ID, &u.DataID, &name, &size, &declaredType, &sniffedType, &owner, &u.Uploaded)
+	u.Name = name.String
+	u.Size = size.Int64
+	u.DeclaredType = declaredType.String
+	u.Type = sniffedType.String
+	u.Owner = owner.String
+	return u, err
+}
+
+// parseBool reports whether a form value is a true boolean like 1 or true.
+func parseBool(value string) bool {
+	b, _ := strconv.ParseBool(value)
+	return b
+}
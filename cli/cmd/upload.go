@@ -6,6 +6,8 @@ package cmd
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -28,6 +30,7 @@ import (
 var (
 	endpoint   string
 	noProgress bool
+	noDeclare  bool
 )
 
 // uploadCmd represents the upload command
@@ -67,6 +70,7 @@ func init() {
 
 	uploadCmd.Flags().StringVarP(&endpoint, "endpoint", "e", "", "YAPC endpoint")
 	uploadCmd.Flags().BoolVarP(&noProgress, "no-progress", "n", false, "Disable progress bar")
+	uploadCmd.Flags().BoolVar(&noDeclare, "no-declare", false, "Always send the whole file, even if the server already has it")
 }
 
 func uploadFileOrDir(path string) error {
@@ -103,6 +107,17 @@ func uploadFile(path string) {
 	}
 	fileSize := fileInfo.Size()
 
+	// Ask the server if it already has the file before sending it
+	if !noDeclare {
+		sha256Hash, stored, err := declareFile(path, fileSize)
+		if err != nil {
+			fmt.Printf("Error checking if %s is already stored: %v\n", path, err)
+		} else if stored {
+			fmt.Printf("Already stored %s: %s\n", path, sha256Hash)
+			return
+		}
+	}
+
 	var bar *progressbar.ProgressBar
 
 	if !noProgress {
@@ -189,6 +204,65 @@ func uploadFile(path string) {
 	fmt.Printf("Uploaded %s: %s\n", path, respData.SHA256)
 }
 
+// declareFile declares the hash and size of a file to the server. If the server already has the
+// file, its challenge is answered and the file does not have to be sent. Servers that do not support
+// declaring files are treated as not having the file.
+func declareFile(path string, size int64) (string, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", false, err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", false, err
+	}
+	sha256Hash := hex.EncodeToString(hasher.Sum(nil))
+
+	var challenge struct {
+		Status    string `json:"status"`
+		Challenge string `json:"challenge"`
+		Offset    int64  `json:"offset"`
+		Length    int64  `json:"length"`
+		Nonce     string `json:"nonce"`
+	}
+	body, _ := json.Marshal(map[string]interface{}{"sha256": sha256Hash, "size": size, "name": filepath.Base(path)})
+	if ok, err := postJSON(endpoint+"/store/declare", body, &challenge); !ok || err != nil {
+		return sha256Hash, false, err
+	}
+	if challenge.Status != "challenge" {
+		return sha256Hash, false, nil
+	}
+
+	// Prove that we have the file by hashing the nonce and the requested part of it
+	proof := sha256.New()
+	proof.Write([]byte(challenge.Nonce))
+	if _, err := io.Copy(proof, io.NewSectionReader(file, challenge.Offset, challenge.Length)); err != nil {
+		return sha256Hash, false, err
+	}
+	body, _ = json.Marshal(map[string]string{"challenge": challenge.Challenge, "proof": hex.EncodeToString(proof.Sum(nil))})
+	ok, err := postJSON(endpoint+"/store/prove", body, nil)
+	return sha256Hash, ok, err
+}
+
+// postJSON posts a JSON body and decodes the response into v. It returns false without an error if
+// the server did not respond with 200.
+func postJSON(url string, body []byte, v interface{}) (bool, error) {
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, nil
+	}
+	if v == nil {
+		return true, nil
+	}
+	return true, json.NewDecoder(resp.Body).Decode(v)
+}
+
 type fpModel struct {
 	filepicker   filepicker.Model
 	selectedFile string
@@ -9,6 +9,10 @@ import (
 
 type Config struct {
 	Endpoint string
+	// SignKey is the -sign:key of the server, used to sign links without asking the server.
+	SignKey string `json:",omitempty"`
+	// Token is the -admin:token of the server.
+	Token string `json:",omitempty"`
 }
 
 // GetString retrieves a specific key from the configuration file located at the given path.
@@ -22,6 +26,10 @@ func GetString(path string, key string) string {
 	switch key {
 	case "Endpoint":
 		return config.Endpoint
+	case "SignKey":
+		return config.SignKey
+	case "Token":
+		return config.Token
 	default:
 		return ""
 	}